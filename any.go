@@ -0,0 +1,106 @@
+package thirdlib
+
+import (
+	"fmt"
+	"time"
+
+	startime "go.starlark.net/lib/time"
+	"go.starlark.net/starlark"
+	"go.starlark.net/starlarkstruct"
+)
+
+// toAny converts v for an interface{} target: dicts and structs become
+// map[string]interface{}, lists, tuples and sets []interface{}, ints int64
+// (or *big.Int if they do not fit), floats float64, and wrapped go values are
+// unwrapped. Other values, like functions, are passed as starlark values.
+func (c *Converter) toAny(v starlark.Value, path map[starlark.Value]bool) (interface{}, error) {
+	switch v := v.(type) {
+	case starlark.NoneType:
+		return nil, nil
+	case *UserValue:
+		return v.goValue(), nil
+	case *Sequence:
+		return v.u.goValue(), nil
+	case *UnboundChan:
+		return v.u.goValue(), nil
+	case starlark.Bool:
+		return bool(v), nil
+	case starlark.Int:
+		if i, ok := v.Int64(); ok {
+			return i, nil
+		}
+		return v.BigInt(), nil
+	case starlark.Float:
+		return float64(v), nil
+	case starlark.String:
+		return string(v), nil
+	case starlark.Bytes:
+		return []byte(v), nil
+	case startime.Time:
+		return time.Time(v), nil
+	case startime.Duration:
+		return time.Duration(v), nil
+	case *starlark.List, starlark.Tuple, *starlark.Set:
+		if _, ok := v.(starlark.Tuple); !ok {
+			// a tuple is immutable, it can not contain itself
+			if err := enterAny(v, path); err != nil {
+				return nil, err
+			}
+			defer delete(path, v)
+		}
+		iter := v.(starlark.Iterable).Iterate()
+		defer iter.Done()
+		elems := []interface{}{}
+		var x starlark.Value
+		for iter.Next(&x) {
+			elem, err := c.toAny(x, path)
+			if err != nil {
+				return nil, err
+			}
+			elems = append(elems, elem)
+		}
+		return elems, nil
+	case *starlark.Dict:
+		if err := enterAny(v, path); err != nil {
+			return nil, err
+		}
+		defer delete(path, v)
+		m := make(map[string]interface{}, v.Len())
+		for _, item := range v.Items() {
+			key, ok := item[0].(starlark.String)
+			if !ok {
+				return nil, fmt.Errorf("cannot use dict with %s key as type map[string]interface {}", item[0].Type())
+			}
+			value, err := c.toAny(item[1], path)
+			if err != nil {
+				return nil, err
+			}
+			m[string(key)] = value
+		}
+		return m, nil
+	case *starlarkstruct.Struct:
+		m := make(map[string]interface{}, len(v.AttrNames()))
+		for _, name := range v.AttrNames() {
+			field, err := v.Attr(name)
+			if err != nil {
+				return nil, err
+			}
+			value, err := c.toAny(field, path)
+			if err != nil {
+				return nil, err
+			}
+			m[name] = value
+		}
+		return m, nil
+	}
+	return v, nil
+}
+
+// enterAny marks the mutable container v as being converted by toAny.
+func enterAny(v starlark.Value, path map[starlark.Value]bool) error {
+	if path[v] {
+		return fmt.Errorf("cannot convert %s containing itself", v.Type())
+	}
+	path[v] = true
+	return nil
+}
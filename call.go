@@ -0,0 +1,279 @@
+package thirdlib
+
+import (
+	"fmt"
+	"reflect"
+	"runtime"
+	"runtime/debug"
+	"strconv"
+	"strings"
+
+	"go.starlark.net/starlark"
+	"go.starlark.net/starlarkstruct"
+)
+
+// Option configures the UserValue created by ToValue.
+type Option func(u *UserValue)
+
+type param struct {
+	name     string
+	optional bool
+}
+
+// WithParams declares the parameter names of a wrapped go function, so it
+// could be called with keyword arguments. names follow starlark.UnpackArgs:
+// a trailing "?" marks the parameter optional, an omitted optional parameter
+// is passed as the zero value of its go type.
+func WithParams(names ...string) Option {
+	return func(u *UserValue) {
+		if u.rtype.Kind() != reflect.Func || u.rtype.NumIn() != len(names) {
+			panic(fmt.Sprintf("WithParams: %d names for %s", len(names), u.rtype))
+		}
+		u.params = make([]param, len(names))
+		for i, name := range names {
+			u.params[i] = param{name: strings.TrimSuffix(name, "?"), optional: strings.HasSuffix(name, "?")}
+		}
+	}
+}
+
+// RaiseErrors makes a wrapped go function report a non-nil trailing error
+// result as a starlark error, the remaining results are returned without
+// it. Values derived from the function, like its results and their methods,
+// inherit the option. Use Try to get the (value, err) tuple back.
+func RaiseErrors() Option {
+	return func(u *UserValue) {
+		u.raiseErrors = true
+	}
+}
+
+// Try is the try_call builtin (try is reserved in starlark), calling its
+// first argument with the remaining arguments. It returns the results of a go
+// function with RaiseErrors as a tuple ending with the error, and
+// (value, error message) for any other callable.
+var Try = starlark.NewBuiltin("try_call", func(thread *starlark.Thread, b *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+	if len(args) < 1 {
+		return nil, fmt.Errorf("%s: got 0 arguments, want at least 1", b.Name())
+	}
+	if u, ok := args[0].(*UserValue); ok && u.raiseErrors {
+		tolerant := *u
+		tolerant.raiseErrors = false
+		return starlark.Call(thread, &tolerant, args[1:], kwargs)
+	}
+	v, err := starlark.Call(thread, args[0], args[1:], kwargs)
+	if err != nil {
+		return starlark.Tuple{starlark.None, starlark.String(err.Error())}, nil
+	}
+	return starlark.Tuple{v, starlark.None}, nil
+})
+
+// Bind is the bind builtin, returning a wrapped go value bound to the calling
+// thread, so that a channel, like one created by ToValue, could be iterated,
+// which ends when the thread is cancelled.
+var Bind = starlark.NewBuiltin("bind", func(thread *starlark.Thread, b *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+	var v starlark.Value
+	if err := starlark.UnpackPositionalArgs(b.Name(), args, kwargs, 1, &v); err != nil {
+		return nil, err
+	}
+	u, ok := asUserValue(v)
+	if !ok {
+		return nil, fmt.Errorf("%s: got %s, want go value", b.Name(), v.Type())
+	}
+	bound := *u
+	bound.thread = thread
+	return bound.starlarkValue(), nil
+})
+
+// bindArgs matches positional and keyword arguments to the parameters of
+// the wrapped function, a nil element stands for the zero value. spread
+// reports that the variadic parameter was passed as a whole by keyword.
+func (u *UserValue) bindArgs(args starlark.Tuple, kwargs []starlark.Tuple) (bound []starlark.Value, spread bool, err error) {
+	if u.params == nil {
+		if len(kwargs) == 0 {
+			return args, false, nil
+		}
+		bound, err = u.bindOptionsStruct(args, kwargs)
+		return bound, false, err
+	}
+
+	numIn := u.rtype.NumIn()
+	variadic := u.rtype.IsVariadic()
+	if !variadic && len(args) > numIn {
+		return nil, false, fmt.Errorf("%s: got %d arguments, want at most %d", u.Name(), len(args), numIn)
+	}
+	bound = make([]starlark.Value, numIn)
+	if len(args) > numIn {
+		bound = make([]starlark.Value, len(args))
+	}
+	copy(bound, args)
+kwloop:
+	for _, item := range kwargs {
+		name := string(item[0].(starlark.String))
+		for i := range u.params {
+			if u.params[i].name == name {
+				if bound[i] != nil {
+					return nil, false, fmt.Errorf("%s: got multiple values for keyword argument %s", u.Name(), name)
+				}
+				bound[i] = item[1]
+				if variadic && i == numIn-1 {
+					spread = true
+				}
+				continue kwloop
+			}
+		}
+		return nil, false, fmt.Errorf("%s: unexpected keyword argument %s", u.Name(), name)
+	}
+	for i := range u.params {
+		if variadic && i == numIn-1 {
+			if bound[i] == nil {
+				bound = bound[:i]
+			}
+			break
+		}
+		if bound[i] == nil && !u.params[i].optional {
+			return nil, false, fmt.Errorf("%s: missing argument for %s", u.Name(), u.params[i].name)
+		}
+	}
+	return bound, spread, nil
+}
+
+// convertArgs converts bound arguments to go values, trailing arguments of a
+// variadic function are converted to its element type unless spread.
+func (u *UserValue) convertArgs(thread *starlark.Thread, args []starlark.Value, spread bool) ([]reflect.Value, error) {
+	numIn := u.rtype.NumIn()
+	if u.rtype.IsVariadic() && !spread {
+		if len(args) < numIn-1 {
+			return nil, fmt.Errorf("%s: got %d arguments, want at least %d", u.Name(), len(args), numIn-1)
+		}
+	} else if len(args) != numIn {
+		return nil, fmt.Errorf("%s: got %d arguments, want %d", u.Name(), len(args), numIn)
+	}
+	var argValues []reflect.Value
+	for i := range args {
+		var inType reflect.Type
+		if i >= numIn-1 && u.rtype.IsVariadic() && !spread {
+			inType = u.rtype.In(numIn - 1).Elem()
+		} else {
+			inType = u.rtype.In(i)
+		}
+		if args[i] == nil {
+			argValues = append(argValues, reflect.Zero(inType))
+			continue
+		}
+		v, err := u.conv.sValueToReflect(thread, args[i], inType)
+		if err != nil {
+			if convErr, ok := err.(conversionError); ok {
+				convErr.Func, convErr.Param = u.Name(), u.paramName(i)
+				return nil, convErr
+			}
+			return nil, fmt.Errorf("%s: for parameter %s: %w", u.Name(), u.paramName(i), err)
+		}
+		argValues = append(argValues, v)
+	}
+	return argValues, nil
+}
+
+// paramName returns the declared name of the i-th parameter, or its 1-based
+// position if parameters are not named.
+func (u *UserValue) paramName(i int) string {
+	if i < len(u.params) {
+		return u.params[i].name
+	}
+	return strconv.Itoa(i + 1)
+}
+
+// NewModule creates a module from members, wrapped go functions are named
+// after the module, like "greet.new", so errors point at the script's view.
+// opts apply to every wrapped go value of members.
+func NewModule(name string, members starlark.StringDict, opts ...Option) *starlarkstruct.Module {
+	for key, member := range members {
+		u, ok := asUserValue(member)
+		if !ok {
+			continue
+		}
+		if u.rtype.Kind() == reflect.Func {
+			u.name = name + "." + key
+		}
+		for _, opt := range opts {
+			opt(u)
+		}
+	}
+	return &starlarkstruct.Module{Name: name, Members: members}
+}
+
+// bindOptionsStruct fills a trailing struct (or pointer to struct) parameter
+// with keyword arguments, keyed by field name.
+func (u *UserValue) bindOptionsStruct(args starlark.Tuple, kwargs []starlark.Tuple) ([]starlark.Value, error) {
+	numIn := u.rtype.NumIn()
+	if numIn == 0 || len(args) != numIn-1 || u.rtype.IsVariadic() {
+		return nil, unsupportedError{Type: u.rtype, Method: "Call with kwargs"}
+	}
+	last := u.rtype.In(numIn - 1)
+	if last.Kind() == reflect.Ptr {
+		last = last.Elem()
+	}
+	if last.Kind() != reflect.Struct {
+		return nil, unsupportedError{Type: u.rtype, Method: "Call with kwargs"}
+	}
+	options := starlark.NewDict(len(kwargs))
+	for _, item := range kwargs {
+		if _, found, _ := options.Get(item[0]); found {
+			return nil, fmt.Errorf("%s: got multiple values for keyword argument %s", u.Name(), item[0])
+		}
+		_ = options.SetKey(item[0], item[1])
+	}
+	bound := make([]starlark.Value, numIn)
+	copy(bound, args)
+	bound[numIn-1] = options
+	return bound, nil
+}
+
+// DebugStack makes errors recovered from go panics carry the go stack trace.
+var DebugStack = false
+
+// PanicError is returned when a go function, method or conversion called
+// from a script panics, instead of crashing the embedding program.
+type PanicError struct {
+	Func  string      // name of the go function or method
+	Value interface{} // recovered panic value
+	Stack []byte      // go stack trace, only if DebugStack is set
+}
+
+func (p *PanicError) Error() string {
+	msg := fmt.Sprintf("%s: go panic: %v", p.Func, p.Value)
+	if p.Stack != nil {
+		msg += "\n" + string(p.Stack)
+	}
+	return msg
+}
+
+func (p *PanicError) Unwrap() error {
+	err, _ := p.Value.(error)
+	return err
+}
+
+// recoverPanic stores a recovered panic as an error in *err, it must be
+// deferred directly by bridge entry points.
+func recoverPanic(name string, err *error) {
+	r := recover()
+	if r == nil {
+		return
+	}
+	p := &PanicError{Func: name, Value: r}
+	if DebugStack {
+		p.Stack = debug.Stack()
+	}
+	*err = p
+}
+
+// funcName returns a short name of a go function, like "thirdlib.NewGreet".
+func funcName(fn reflect.Value) string {
+	f := runtime.FuncForPC(fn.Pointer())
+	if f == nil {
+		return fn.Type().String()
+	}
+	name := f.Name()
+	if i := strings.LastIndex(name, "/"); i >= 0 {
+		name = name[i+1:]
+	}
+	return name
+}
@@ -0,0 +1,91 @@
+package thirdlib
+
+import (
+	"fmt"
+	"reflect"
+
+	"go.starlark.net/starlark"
+)
+
+// makeFunc returns a go func of type hint calling fn, see callbackCaller for
+// the thread it runs on. If hint ends with an error result, a failing call,
+// or a result that could not be converted, is returned as that error,
+// otherwise the func returns zero values and the error fails the go call
+// fn was passed to, see callbackCaller.report.
+func (c *Converter) makeFunc(thread *starlark.Thread, fn starlark.Callable, hint reflect.Type) reflect.Value {
+	numOut := hint.NumOut()
+	returnsErr := numOut > 0 && hint.Out(numOut-1) == refTypeError
+	numValues := numOut
+	if returnsErr {
+		numValues--
+	}
+	caller := newCallbackCaller(thread)
+	fail := func(err error) []reflect.Value {
+		ret := make([]reflect.Value, numOut)
+		for i := 0; i < numValues; i++ {
+			ret[i] = reflect.Zero(hint.Out(i))
+		}
+		if !returnsErr {
+			caller.report(err)
+			return ret
+		}
+		ret[numValues] = reflect.New(refTypeError).Elem()
+		ret[numValues].Set(reflect.ValueOf(err))
+		return ret
+	}
+	return reflect.MakeFunc(hint, func(args []reflect.Value) []reflect.Value {
+		var goArgs []interface{}
+		for i, arg := range args {
+			if hint.IsVariadic() && i == len(args)-1 {
+				for j := 0; j < arg.Len(); j++ {
+					goArgs = append(goArgs, arg.Index(j).Interface())
+				}
+				break
+			}
+			goArgs = append(goArgs, arg.Interface())
+		}
+		sArgs := make(starlark.Tuple, len(goArgs))
+		for i, arg := range goArgs {
+			v, err := c.toValue(arg, thread)
+			if err != nil {
+				return fail(fmt.Errorf("%s: %w", fn.Name(), err))
+			}
+			sArgs[i] = v
+		}
+		value, err := caller.call(fn, sArgs)
+		if err != nil {
+			return fail(err)
+		}
+
+		var results []starlark.Value
+		switch numValues {
+		case 0:
+			if value != starlark.None {
+				return fail(fmt.Errorf("%s: got %s result, want None", fn.Name(), value.Type()))
+			}
+		case 1:
+			results = []starlark.Value{value}
+		default:
+			tuple, ok := value.(starlark.Tuple)
+			if !ok {
+				return fail(fmt.Errorf("%s: got %s result, want tuple of %d", fn.Name(), value.Type(), numValues))
+			}
+			if len(tuple) != numValues {
+				return fail(fmt.Errorf("%s: got %d results, want %d", fn.Name(), len(tuple), numValues))
+			}
+			results = tuple
+		}
+		ret := make([]reflect.Value, 0, numOut)
+		for i, result := range results {
+			v, err := c.sValueToReflect(thread, result, hint.Out(i))
+			if err != nil {
+				return fail(err)
+			}
+			ret = append(ret, v)
+		}
+		if returnsErr {
+			ret = append(ret, reflect.Zero(refTypeError))
+		}
+		return ret
+	})
+}
@@ -0,0 +1,151 @@
+package thirdlib
+
+import (
+	"context"
+	"reflect"
+	"time"
+
+	"go.starlark.net/starlark"
+)
+
+// ContextLocal is the thread local holding the context.Context go calls of
+// a thread derive their context from, context.Background() if it is not
+// set. Set it before running the script:
+//
+//	thread.SetLocal(thirdlib.ContextLocal, ctx)
+//
+// The derived context is only released when ctx is done, use BindContext
+// for a ctx outliving the thread, like the context of a server.
+const ContextLocal = "thirdlib.context"
+
+// threadContextLocal holds the *threadContext of a thread.
+const threadContextLocal = "thirdlib.threadContext"
+
+var refTypeContext = reflect.TypeOf((*context.Context)(nil)).Elem()
+
+// threadContext is the context passed to go functions of a thread, it is
+// cancelled when the thread is cancelled, or exceeds its steps.
+type threadContext struct {
+	ctx    context.Context
+	cancel context.CancelFunc
+}
+
+// BindContext makes go calls of thread derive their context from ctx, like
+// ContextLocal. Call release when the thread is done, it cancels the derived
+// context, so a long-lived ctx does not keep it:
+//
+//	release := thirdlib.BindContext(thread, ctx)
+//	defer release()
+func BindContext(thread *starlark.Thread, ctx context.Context) (release func()) {
+	if tc, ok := thread.Local(threadContextLocal).(*threadContext); ok {
+		tc.cancel()
+	}
+	thread.SetLocal(ContextLocal, ctx)
+	tc := newThreadContext(ctx)
+	thread.SetLocal(threadContextLocal, tc)
+	return tc.cancel
+}
+
+// threadContextKey is the context key under which a thread context holds
+// its *threadContext, so contexts derived from it can be recognized.
+type threadContextKey struct{}
+
+func newThreadContext(parent context.Context) *threadContext {
+	tc := &threadContext{}
+	ctx, cancel := context.WithCancel(parent)
+	tc.ctx, tc.cancel = context.WithValue(ctx, threadContextKey{}, tc), cancel
+	return tc
+}
+
+// contextOf returns the context of thread, creating it on first use.
+func contextOf(thread *starlark.Thread) context.Context {
+	if thread == nil {
+		return context.Background()
+	}
+	if tc, ok := thread.Local(threadContextLocal).(*threadContext); ok {
+		return tc.ctx
+	}
+	parent, ok := thread.Local(ContextLocal).(context.Context)
+	if !ok {
+		parent = context.Background()
+	}
+	tc := newThreadContext(parent)
+	thread.SetLocal(threadContextLocal, tc)
+	return tc.ctx
+}
+
+// usesThreadContext reports whether one of args is the context of thread,
+// or derived from it, so the go call must see the thread being cancelled.
+func usesThreadContext(thread *starlark.Thread, args []reflect.Value) bool {
+	if thread == nil {
+		return false
+	}
+	tc, ok := thread.Local(threadContextLocal).(*threadContext)
+	if !ok {
+		return false
+	}
+	for _, arg := range args {
+		if !arg.IsValid() || !arg.Type().Implements(refTypeContext) {
+			continue
+		}
+		if (arg.Kind() == reflect.Ptr || arg.Kind() == reflect.Interface) && arg.IsNil() {
+			continue
+		}
+		if arg.Interface().(context.Context).Value(threadContextKey{}) == tc {
+			return true
+		}
+	}
+	return false
+}
+
+// watchCancel cancels the context of thread, if it has one, when the thread
+// is cancelled before stop is called. A thread is only watched while it is
+// blocked in a go call using its context, which is when its cancellation
+// must reach go code.
+func watchCancel(thread *starlark.Thread) (stop func()) {
+	if thread == nil {
+		return func() {}
+	}
+	tc, ok := thread.Local(threadContextLocal).(*threadContext)
+	if !ok {
+		return func() {}
+	}
+	if _, cancelled := cancelReason(thread); cancelled {
+		tc.cancel()
+		return func() {}
+	}
+	done := make(chan struct{})
+	go func() {
+		ticker := time.NewTicker(cancelPollInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-tc.ctx.Done():
+				return
+			case <-ticker.C:
+				if _, cancelled := cancelReason(thread); cancelled {
+					tc.cancel()
+					return
+				}
+			}
+		}
+	}()
+	return func() { close(done) }
+}
+
+// injectContext reports whether a call of u with args gets the context of
+// the thread as its leading context.Context argument, which it does unless
+// the script passed a context.
+func (u *UserValue) injectContext(args starlark.Tuple) bool {
+	if u.rtype.NumIn() == 0 || u.rtype.In(0) != refTypeContext {
+		return false
+	}
+	if len(args) > 0 {
+		if arg, ok := args[0].(*UserValue); ok && arg.rtype.Implements(refTypeContext) {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,118 @@
+package thirdlib
+
+import (
+	"reflect"
+	"sync"
+
+	"go.starlark.net/starlark"
+)
+
+// Marshaler converts a go value of a registered type to a starlark value.
+type Marshaler func(v reflect.Value) (starlark.Value, error)
+
+// Unmarshaler converts a starlark value to a go value of the registered type
+// hint.
+type Unmarshaler func(v starlark.Value, hint reflect.Type) (reflect.Value, error)
+
+// Converter converts values between go and starlark, custom conversions of
+// go types could be registered to it. Values wrapped by a Converter keep
+// using it for their fields, elements and call results.
+// Options of a Converter must be set before it is used.
+type Converter struct {
+	// TagName is the struct tag naming fields for scripts, "starlark" with
+	// NewConverter, tags are ignored if it is empty. A field tagged "-" is
+	// hidden.
+	TagName string
+	// JSONTags makes fields without a TagName tag named by their json tag.
+	JSONTags bool
+	// SnakeCaseFields makes untagged fields named in snake_case, like
+	// status_code for StatusCode.
+	SnakeCaseFields bool
+	// SnakeCaseMethods exposes methods under snake_case aliases too, like
+	// rename_with_func for RenameWithFunc. Fields win a collision with an
+	// alias.
+	SnakeCaseMethods bool
+	// CopyOnFreeze makes a frozen map or slice a deep copy of the go value,
+	// see UserValue.Freeze.
+	CopyOnFreeze bool
+	// KeepNamedNumbers wraps values of named numeric types, like
+	// time.Duration, as UserValue keeping their methods and operators,
+	// instead of converting them to int or float.
+	KeepNamedNumbers bool
+	// SliceViews makes x[i:j] of a go slice or array a UserValue sharing
+	// memory with x, instead of a copied list. Slices with a step other than
+	// 1 are copied to a new go slice.
+	SliceViews bool
+	// SortedMapKeys makes iterating a go map, and its keys, values and
+	// items methods, follow the order of its keys instead of go's random
+	// order.
+	SortedMapKeys bool
+	// MaxDepth limits the nesting followed by ToStarlark, DefaultMaxDepth
+	// if 0.
+	MaxDepth int
+	// StructRecords makes ToValue convert structs, and pointers to structs,
+	// to immutable starlarkstruct records with ToStruct instead of wrapping
+	// them, so their methods are not available to scripts.
+	StructRecords bool
+	// TextMarshalers makes ToValue and ToStarlark convert values
+	// implementing encoding.TextMarshaler, or else fmt.Stringer, to strings,
+	// like net.IP. Values with a built-in mapping keep it, like numbers,
+	// *big.Int, or time.Time in ToStarlark.
+	TextMarshalers bool
+
+	marshalers   map[reflect.Type]Marshaler
+	unmarshalers map[reflect.Type]Unmarshaler
+	fieldCache   sync.Map // reflect.Type -> []structField
+	methodCache  sync.Map // reflect.Type -> map[string]int
+}
+
+// DefaultConverter is used by the package level ToValue and ToStarlark.
+var DefaultConverter = NewConverter()
+
+// NewConverter returns a Converter naming fields by their starlark tag. A
+// zero Converter is usable too, it ignores struct tags.
+func NewConverter() *Converter {
+	return &Converter{
+		TagName:      "starlark",
+		marshalers:   map[reflect.Type]Marshaler{},
+		unmarshalers: map[reflect.Type]Unmarshaler{},
+	}
+}
+
+// RegisterMarshaler makes c convert go values of exactly type t with fn.
+// Registration is not safe while c is in use.
+func (c *Converter) RegisterMarshaler(t reflect.Type, fn Marshaler) {
+	if c.marshalers == nil {
+		c.marshalers = map[reflect.Type]Marshaler{}
+	}
+	c.marshalers[t] = fn
+}
+
+// RegisterUnmarshaler makes c convert starlark values passed where type t is
+// expected with fn. Registration is not safe while c is in use.
+func (c *Converter) RegisterUnmarshaler(t reflect.Type, fn Unmarshaler) {
+	if c.unmarshalers == nil {
+		c.unmarshalers = map[reflect.Type]Unmarshaler{}
+	}
+	c.unmarshalers[t] = fn
+}
+
+// marshal converts v with a registered marshaler, ok reports whether one is
+// registered for the type of v.
+func (c *Converter) marshal(v reflect.Value) (_ starlark.Value, ok bool, err error) {
+	if !v.IsValid() {
+		return nil, false, nil
+	}
+	fn, ok := c.marshalers[v.Type()]
+	if !ok {
+		return nil, false, nil
+	}
+	sv, err := fn(v)
+	return sv, true, err
+}
+
+func (c *Converter) newUserValue(value interface{}, thread *starlark.Thread) *UserValue {
+	u := NewUserValue(value, thread)
+	u.conv = c
+	return u
+}
@@ -0,0 +1,292 @@
+package thirdlib
+
+import (
+	"fmt"
+	"reflect"
+	"time"
+
+	startime "go.starlark.net/lib/time"
+	"go.starlark.net/starlark"
+	"go.starlark.net/starlarkstruct"
+)
+
+// DefaultMaxDepth limits the nesting ToStarlark follows when the
+// converter's MaxDepth is 0.
+const DefaultMaxDepth = 64
+
+var (
+	refTypeTime     = reflect.TypeOf(time.Time{})
+	refTypeDuration = reflect.TypeOf(time.Duration(0))
+)
+
+// ToStarlark converts a go value to native starlark values deeply: slices
+// and arrays become lists, maps dicts, structs starlarkstruct structs,
+// time.Time and time.Duration values of the time module, pointers and
+// interfaces are followed. Unlike ToValue nothing is wrapped as UserValue,
+// values like funcs and channels are an error, as are cycles.
+func ToStarlark(value interface{}) (starlark.Value, error) {
+	return DefaultConverter.ToStarlark(value)
+}
+
+// FromStarlark converts v to the go value out points to, like arguments of a
+// wrapped go function are converted:
+//
+//	var opts Options
+//	err := thirdlib.FromStarlark(v, &opts)
+func FromStarlark(v starlark.Value, out interface{}) error {
+	return DefaultConverter.FromStarlark(v, out)
+}
+
+// ToStarlark is like the package level ToStarlark, using the marshalers
+// registered to c.
+func (c *Converter) ToStarlark(value interface{}) (starlark.Value, error) {
+	d := deepConverter{c: c, maxDepth: c.MaxDepth, path: map[deepKey]bool{}}
+	if d.maxDepth == 0 {
+		d.maxDepth = DefaultMaxDepth
+	}
+	return d.convert(reflect.ValueOf(value), 0)
+}
+
+// FromStarlark is like the package level FromStarlark, using the
+// unmarshalers registered to c.
+func (c *Converter) FromStarlark(v starlark.Value, out interface{}) (err error) {
+	defer recoverPanic("FromStarlark", &err)
+	ptr := reflect.ValueOf(out)
+	if ptr.Kind() != reflect.Ptr || ptr.IsNil() {
+		return fmt.Errorf("FromStarlark: got %T, want non-nil pointer", out)
+	}
+	rv, err := c.sValueToReflect(nil, v, ptr.Type().Elem())
+	if err != nil {
+		return err
+	}
+	ptr.Elem().Set(rv)
+	return nil
+}
+
+// ToStruct is the to_struct builtin, converting a wrapped go struct, or
+// pointer to a struct, to a starlarkstruct record.
+var ToStruct = starlark.NewBuiltin("to_struct", func(thread *starlark.Thread, b *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+	var v starlark.Value
+	if err := starlark.UnpackPositionalArgs(b.Name(), args, kwargs, 1, &v); err != nil {
+		return nil, err
+	}
+	switch v := v.(type) {
+	case *starlarkstruct.Struct:
+		return v, nil
+	case *UserValue:
+		s, err := v.conv.toStruct(v.goValue(), thread)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", b.Name(), err)
+		}
+		return s, nil
+	}
+	return nil, fmt.Errorf("%s: got %s, want go struct", b.Name(), v.Type())
+})
+
+// ToStruct converts a go struct, or a pointer to a struct, to a
+// starlarkstruct record like ToStarlark, fields are named like fields of
+// a wrapped struct. Values ToStarlark could not convert, like funcs,
+// channels or cycles, are wrapped as UserValue instead.
+func (c *Converter) ToStruct(value interface{}) (*starlarkstruct.Struct, error) {
+	return c.toStruct(value, nil)
+}
+
+// toStruct is like ToStruct, wrapped values are bound to thread.
+func (c *Converter) toStruct(value interface{}, thread *starlark.Thread) (*starlarkstruct.Struct, error) {
+	if !isStruct(reflect.ValueOf(value)) {
+		return nil, fmt.Errorf("ToStruct: got %T, want struct", value)
+	}
+	v, err := c.toRecord(value, thread)
+	if err != nil {
+		return nil, err
+	}
+	s, ok := v.(*starlarkstruct.Struct)
+	if !ok {
+		// converted otherwise, like time.Time
+		return nil, fmt.Errorf("ToStruct: got %s for %T, want struct", v.Type(), value)
+	}
+	return s, nil
+}
+
+// toRecord converts value like ToStarlark, wrapping values it could not
+// convert as UserValue bound to thread.
+func (c *Converter) toRecord(value interface{}, thread *starlark.Thread) (starlark.Value, error) {
+	d := deepConverter{c: c, maxDepth: c.MaxDepth, path: map[deepKey]bool{}, wrap: true, thread: thread}
+	if d.maxDepth == 0 {
+		d.maxDepth = DefaultMaxDepth
+	}
+	return d.convert(reflect.ValueOf(value), 0)
+}
+
+// isStruct reports whether v is a struct or a non-nil pointer to one.
+func isStruct(v reflect.Value) bool {
+	if v.Kind() == reflect.Ptr && !v.IsNil() {
+		v = v.Elem()
+	}
+	return v.Kind() == reflect.Struct
+}
+
+// deepKey identifies a map, slice or pointer on the path being converted.
+type deepKey struct {
+	t   reflect.Type
+	ptr uintptr
+	len int
+}
+
+type deepConverter struct {
+	c        *Converter
+	maxDepth int
+	path     map[deepKey]bool
+	wrap     bool // wrap values that could not be converted, see fallback
+	thread   *starlark.Thread
+}
+
+func (d *deepConverter) convert(v reflect.Value, depth int) (starlark.Value, error) {
+	if !v.IsValid() {
+		return starlark.None, nil
+	}
+	if depth > d.maxDepth {
+		return d.fallback(v, fmt.Errorf("ToStarlark: %s exceeds max depth %d", v.Type(), d.maxDepth))
+	}
+	if sv, ok, err := d.c.marshal(v); err != nil {
+		return nil, err
+	} else if ok {
+		return sv, nil
+	}
+	if v.CanInterface() {
+		if sv, ok := v.Interface().(starlark.Value); ok {
+			return sv, nil
+		}
+	}
+	if sv, ok := bigToStarlark(v); ok {
+		return sv, nil
+	}
+	switch v.Type() {
+	case refTypeTime:
+		return startime.Time(v.Interface().(time.Time)), nil
+	case refTypeDuration:
+		return startime.Duration(v.Int()), nil
+	}
+	if sv, ok, err := d.c.marshalText(v); err != nil {
+		return nil, err
+	} else if ok {
+		return sv, nil
+	}
+
+	switch v.Kind() {
+	case reflect.Bool:
+		return starlark.Bool(v.Bool()), nil
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return starlark.MakeInt64(v.Int()), nil
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		return starlark.MakeUint64(v.Uint()), nil
+	case reflect.Float32, reflect.Float64:
+		return starlark.Float(v.Float()), nil
+	case reflect.String:
+		return starlark.String(v.String()), nil
+	case reflect.Interface:
+		if v.IsNil() {
+			return starlark.None, nil
+		}
+		return d.convert(v.Elem(), depth)
+	case reflect.Ptr:
+		if v.IsNil() {
+			return starlark.None, nil
+		}
+		leave, err := d.enter(v)
+		if err != nil {
+			return d.fallback(v, err)
+		}
+		defer leave()
+		return d.convert(v.Elem(), depth+1)
+	case reflect.Slice, reflect.Array:
+		if v.Kind() == reflect.Slice {
+			if v.IsNil() {
+				return starlark.None, nil
+			}
+			if v.Type().Elem().Kind() == reflect.Uint8 {
+				return starlark.Bytes(v.Bytes()), nil
+			}
+			leave, err := d.enter(v)
+			if err != nil {
+				return d.fallback(v, err)
+			}
+			defer leave()
+		}
+		elems := make([]starlark.Value, v.Len())
+		for i := range elems {
+			elem, err := d.convert(v.Index(i), depth+1)
+			if err != nil {
+				return nil, err
+			}
+			elems[i] = elem
+		}
+		return starlark.NewList(elems), nil
+	case reflect.Map:
+		if v.IsNil() {
+			return starlark.None, nil
+		}
+		leave, err := d.enter(v)
+		if err != nil {
+			return d.fallback(v, err)
+		}
+		defer leave()
+		dict := starlark.NewDict(v.Len())
+		iter := v.MapRange()
+		for iter.Next() {
+			key, err := d.convert(iter.Key(), depth+1)
+			if err != nil {
+				return nil, err
+			}
+			value, err := d.convert(iter.Value(), depth+1)
+			if err != nil {
+				return nil, err
+			}
+			if err := dict.SetKey(key, value); err != nil {
+				return nil, fmt.Errorf("ToStarlark: %s: %w", v.Type(), err)
+			}
+		}
+		return dict, nil
+	case reflect.Struct:
+		members := starlark.StringDict{}
+		for _, f := range d.c.structFields(v.Type()) {
+			field := fieldByIndex(v, f.index, false)
+			value, err := d.convert(field, depth+1)
+			if err != nil {
+				return nil, err
+			}
+			members[f.name] = value
+		}
+		return starlarkstruct.FromStringDict(starlarkstruct.Default, members), nil
+	}
+	return d.fallback(v, fmt.Errorf("ToStarlark: cannot convert %s", v.Type()))
+}
+
+// fallback wraps v as UserValue when converting records, so fields like
+// funcs, channels or cycles stay usable instead of failing with err.
+func (d *deepConverter) fallback(v reflect.Value, err error) (starlark.Value, error) {
+	if !d.wrap || !v.CanInterface() {
+		return nil, err
+	}
+	switch v.Kind() {
+	case reflect.Chan, reflect.Func, reflect.Map, reflect.Ptr, reflect.Slice, reflect.UnsafePointer:
+		if v.IsNil() {
+			return starlark.None, nil
+		}
+	}
+	return d.c.newUserValue(v.Interface(), d.thread).starlarkValue(), nil
+}
+
+// enter marks the map, slice or pointer v as being converted, converting it
+// again before leave is called is a cycle.
+func (d *deepConverter) enter(v reflect.Value) (leave func(), err error) {
+	key := deepKey{t: v.Type(), ptr: v.Pointer()}
+	if v.Kind() == reflect.Slice {
+		key.len = v.Len()
+	}
+	if d.path[key] {
+		return nil, fmt.Errorf("ToStarlark: cycle through %s", v.Type())
+	}
+	d.path[key] = true
+	return func() { delete(d.path, key) }, nil
+}
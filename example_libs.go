@@ -11,6 +11,7 @@ import (
 	"os/exec"
 	"regexp"
 	"strings"
+	"time"
 
 	"go.starlark.net/starlark"
 	"go.starlark.net/starlarkstruct"
@@ -50,116 +51,97 @@ func NewGreetWith(name string) *Greet {
 
 func InstallAllExampleModule(d starlark.StringDict) {
 	for _, v := range exampleModules {
+		v.Freeze()
 		d[v.Name] = v
 	}
 }
 
-var GreetModule = &starlarkstruct.Module{
-	Name: "greet",
-	Members: starlark.StringDict{
-		"new":         ToValue(NewGreet),
-		"default":     ToValue(&Greet{}),
-		"newWithName": ToValue(NewGreetWith),
-	},
-}
+var GreetModule = NewModule("greet", starlark.StringDict{
+	"new":         ToValue(NewGreet),
+	"default":     ToValue(&Greet{}),
+	"newWithName": ToValue(NewGreetWith, WithParams("name")),
+})
 
 type M = map[string]interface{}
 type E = []M
 
 var exampleModules = []*starlarkstruct.Module{
 	GreetModule,
-	{
-		Name: "modules",
-		Members: starlark.StringDict{
-			"all": ToValue(func() (ret []string) {
-				for _, v := range starlark.Universe {
-					if m, ok := v.(*starlarkstruct.Module); ok {
-						ret = append(ret, m.Name)
-					}
+	NewModule("modules", starlark.StringDict{
+		"all": ToValue(func() (ret []string) {
+			for _, v := range starlark.Universe {
+				if m, ok := v.(*starlarkstruct.Module); ok {
+					ret = append(ret, m.Name)
 				}
-				return
-			}),
-			"inspect": ToValue(func(a string) (ret []string) {
-				if v, ok := starlark.Universe[a]; ok {
-					if m, ok := v.(*starlarkstruct.Module); ok {
-						for x, y := range m.Members {
-							ret = append(ret, fmt.Sprintf("%s: [%s, %s]", x, y.Type(), y.String()))
-						}
+			}
+			return
+		}),
+		"inspect": ToValue(func(a string) (ret []string) {
+			if v, ok := starlark.Universe[a]; ok {
+				if m, ok := v.(*starlarkstruct.Module); ok {
+					for _, x := range m.Members.Keys() {
+						y := m.Members[x]
+						ret = append(ret, fmt.Sprintf("%s: [%s, %s]", x, y.Type(), y.String()))
 					}
 				}
-				return
-			}),
-		},
-	},
-	{
-		Name: "go",
-		Members: starlark.StringDict{
-			"new_e":        ToValue(func() E { return E{} }),
-			"new_m":        ToValue(func() M { return M{} }),
-			"new_e_ptr":    ToValue(func() *E { return &E{} }),
-			"new_m_ptr":    ToValue(func() *M { return &M{} }),
-			"to_star_type": ToValue(func(a interface{}) starlark.Value { return DecodeValue(a) }),
-		},
-	},
-	{
-		Name: "http",
-		Members: starlark.StringDict{
-			"get":           ToValue(http.Get),
-			"pos":           ToValue(http.Post),
-			"defaultClient": ToValue(http.DefaultClient),
-		},
-	},
-	{
-		Name: "ioutil",
-		Members: starlark.StringDict{
-			"read_all":   ToValue(ioutil.ReadAll),
-			"read_file":  ToValue(os.ReadFile),
-			"write_file": ToValue(os.WriteFile),
-			"read_dir":   ToValue(os.ReadDir),
-		},
-	},
-	{
-		Name: "strings",
-		Members: starlark.StringDict{
-			"contains": ToValue(strings.Contains),
-			"split":    ToValue(strings.Split),
-		},
-	},
-	{
-		Name: "context",
-		Members: starlark.StringDict{
-			"background": ToValue(context.Background),
-		}}, {
-		Name: "regexp",
-		Members: starlark.StringDict{
-			"compile":      ToValue(regexp.Compile),
-			"match":        ToValue(regexp.Match),
-			"match_string": ToValue(regexp.MatchString),
-		},
-	},
-	{
-		Name: "url",
-		Members: starlark.StringDict{
-			"parse": ToValue(url.Parse),
-		},
-	},
-	{
-		Name: "exec",
-		Members: starlark.StringDict{
-			"cmd": ToValue(exec.Command),
-			"run": ToValue(func(a ...string) ([]byte, []byte, error) {
-				out, err := bytes.NewBuffer(nil), bytes.NewBuffer(nil)
-				cmd := exec.Command(a[0], a[1:]...)
-				cmd.Stdout, cmd.Stderr = out, err
-				err1 := cmd.Run()
-				return out.Bytes(), err.Bytes(), err1
-			}),
-		},
-	},
-	{
-		Name: "resty",
-		Members: starlark.StringDict{
-			"new": ToValue(resty.New),
-		},
-	},
+			}
+			return
+		}),
+	}),
+	NewModule("go", starlark.StringDict{
+		"new_e":        ToValue(func() E { return E{} }),
+		"new_m":        ToValue(func() M { return M{} }),
+		"new_e_ptr":    ToValue(func() *E { return &E{} }),
+		"new_m_ptr":    ToValue(func() *M { return &M{} }),
+		"to_star_type": ToValue(ToStarlark, RaiseErrors()),
+		"try_call":     Try,
+		"to_struct":    ToStruct,
+		"bind":         Bind,
+	}),
+	NewModule("http", starlark.StringDict{
+		"get":           ToValue(http.Get),
+		"pos":           ToValue(http.Post),
+		"defaultClient": ToValue(http.DefaultClient),
+	}),
+	NewModule("fmt", starlark.StringDict{
+		"sprintf": ToValue(fmt.Sprintf, WithParams("format", "a")),
+	}),
+	NewModule("ioutil", starlark.StringDict{
+		"read_all":   ToValue(ioutil.ReadAll),
+		"read_file":  ToValue(os.ReadFile),
+		"write_file": ToValue(os.WriteFile),
+		"read_dir":   ToValue(os.ReadDir),
+	}),
+	NewModule("strings", starlark.StringDict{
+		"contains": ToValue(strings.Contains),
+		"split":    ToValue(strings.Split),
+	}),
+	NewModule("context", starlark.StringDict{
+		"background":  ToValue(context.Background),
+		"with_cancel": ToValue(context.WithCancel),
+		"with_timeout": ToValue(func(parent context.Context, seconds float64) (context.Context, context.CancelFunc) {
+			return context.WithTimeout(parent, time.Duration(seconds*float64(time.Second)))
+		}),
+	}),
+	NewModule("regexp", starlark.StringDict{
+		"compile":      ToValue(regexp.Compile),
+		"match":        ToValue(regexp.Match),
+		"match_string": ToValue(regexp.MatchString),
+	}),
+	NewModule("url", starlark.StringDict{
+		"parse": ToValue(url.Parse),
+	}),
+	NewModule("exec", starlark.StringDict{
+		"cmd": ToValue(exec.Command),
+		"run": ToValue(func(a ...string) ([]byte, []byte, error) {
+			out, err := bytes.NewBuffer(nil), bytes.NewBuffer(nil)
+			cmd := exec.Command(a[0], a[1:]...)
+			cmd.Stdout, cmd.Stderr = out, err
+			err1 := cmd.Run()
+			return out.Bytes(), err.Bytes(), err1
+		}),
+	}),
+	NewModule("resty", starlark.StringDict{
+		"new": ToValue(resty.New),
+	}),
 }
@@ -0,0 +1,205 @@
+package thirdlib
+
+import (
+	"reflect"
+	"strings"
+	"unicode"
+)
+
+type structField struct {
+	name  string // name seen by scripts
+	index []int
+}
+
+// structFields returns the exported fields of struct type t visible to
+// scripts, including fields promoted from embedded structs. Like in go, a
+// shallower field hides deeper ones, and fields of a name at the same depth
+// hide each other.
+func (c *Converter) structFields(t reflect.Type) []structField {
+	if cached, ok := c.fieldCache.Load(t); ok {
+		return cached.([]structField)
+	}
+	type candidate struct {
+		structField
+		depth int
+	}
+	var candidates []candidate
+	visited := map[reflect.Type]bool{}
+	var walk func(t reflect.Type, index []int, depth int)
+	walk = func(t reflect.Type, index []int, depth int) {
+		if visited[t] {
+			return
+		}
+		visited[t] = true
+		for i := 0; i < t.NumField(); i++ {
+			sf := t.Field(i)
+			name := c.fieldName(sf)
+			if name == "-" {
+				continue
+			}
+			fieldIndex := append(append([]int(nil), index...), i)
+			if sf.Anonymous && tagName(sf, c.TagName) == "" {
+				ft := sf.Type
+				if ft.Kind() == reflect.Ptr {
+					ft = ft.Elem()
+				}
+				if ft.Kind() == reflect.Struct {
+					walk(ft, fieldIndex, depth+1)
+				}
+			}
+			if sf.PkgPath == "" {
+				candidates = append(candidates, candidate{structField{name: name, index: fieldIndex}, depth})
+			}
+		}
+	}
+	walk(t, nil, 0)
+
+	minDepth, count := map[string]int{}, map[string]int{}
+	for _, f := range candidates {
+		if d, ok := minDepth[f.name]; !ok || f.depth < d {
+			minDepth[f.name], count[f.name] = f.depth, 0
+		}
+		if f.depth == minDepth[f.name] {
+			count[f.name]++
+		}
+	}
+	var fields []structField
+	for _, f := range candidates {
+		if f.depth == minDepth[f.name] && count[f.name] == 1 {
+			fields = append(fields, f.structField)
+		}
+	}
+	c.fieldCache.Store(t, fields)
+	return fields
+}
+
+// fieldName returns the name of a struct field seen by scripts, "-" if the
+// field is hidden.
+func (c *Converter) fieldName(sf reflect.StructField) string {
+	if name := tagName(sf, c.TagName); name != "" {
+		return name
+	}
+	if c.JSONTags {
+		if name := tagName(sf, "json"); name != "" {
+			return name
+		}
+	}
+	if c.SnakeCaseFields {
+		return snakeCase(sf.Name)
+	}
+	return sf.Name
+}
+
+func tagName(sf reflect.StructField, key string) string {
+	if key == "" {
+		return ""
+	}
+	tag, ok := sf.Tag.Lookup(key)
+	if !ok {
+		return ""
+	}
+	return strings.Split(tag, ",")[0]
+}
+
+// fieldByName returns the field of struct v named name by scripts, the go
+// name of a field is accepted too unless the field is hidden. A nil embedded
+// pointer on the way is allocated if alloc is set, otherwise the returned
+// field is invalid.
+func (c *Converter) fieldByName(v reflect.Value, name string, alloc bool) (reflect.Value, bool) {
+	for _, f := range c.structFields(v.Type()) {
+		if f.name == name {
+			return fieldByIndex(v, f.index, alloc), true
+		}
+	}
+	sf, ok := v.Type().FieldByName(name)
+	if !ok || sf.PkgPath != "" || c.fieldName(sf) == "-" {
+		return reflect.Value{}, false
+	}
+	return fieldByIndex(v, sf.Index, alloc), true
+}
+
+func fieldByIndex(v reflect.Value, index []int, alloc bool) reflect.Value {
+	for i, x := range index {
+		if i > 0 && v.Kind() == reflect.Ptr {
+			if v.IsNil() {
+				if !alloc || !v.CanSet() {
+					return reflect.Value{}
+				}
+				v.Set(reflect.New(v.Type().Elem()))
+			}
+			v = v.Elem()
+		}
+		v = v.Field(x)
+	}
+	return v
+}
+
+// methodReceiver returns the value whose methods are visible to scripts, a
+// non-pointer value is addressed, so methods with pointer receivers are
+// included. Wrapped values are addressable (see addressable), others are
+// copied, which is only fit for listing methods.
+func methodReceiver(v reflect.Value) reflect.Value {
+	switch {
+	case v.Kind() == reflect.Ptr || v.Kind() == reflect.Interface:
+		return v
+	case v.CanAddr():
+		return v.Addr()
+	}
+	p := reflect.New(v.Type())
+	p.Elem().Set(v)
+	return p
+}
+
+// methodByName returns the method of v named name by scripts, which is its
+// go name, or its snake_case alias if aliases and SnakeCaseMethods are set.
+func (c *Converter) methodByName(v reflect.Value, name string, aliases bool) (reflect.Value, bool) {
+	if m := v.MethodByName(name); m.IsValid() {
+		return m, true
+	}
+	recv := methodReceiver(v)
+	if m := recv.MethodByName(name); m.IsValid() {
+		return m, true
+	}
+	if !aliases || !c.SnakeCaseMethods {
+		return reflect.Value{}, false
+	}
+	if i, ok := c.methodAliases(recv.Type())[name]; ok {
+		return recv.Method(i), true
+	}
+	return reflect.Value{}, false
+}
+
+// methodAliases maps the snake_case aliases of the methods of t to method
+// indexes. Methods are sorted by go name, the first one wins a collision.
+func (c *Converter) methodAliases(t reflect.Type) map[string]int {
+	if cached, ok := c.methodCache.Load(t); ok {
+		return cached.(map[string]int)
+	}
+	aliases := map[string]int{}
+	for i := 0; i < t.NumMethod(); i++ {
+		alias := snakeCase(t.Method(i).Name)
+		if _, ok := aliases[alias]; !ok {
+			aliases[alias] = i
+		}
+	}
+	c.methodCache.Store(t, aliases)
+	return aliases
+}
+
+// snakeCase converts a go identifier to snake_case, like StatusCode to
+// status_code and HTTPServer to http_server.
+func snakeCase(name string) string {
+	runes := []rune(name)
+	var b strings.Builder
+	for i, r := range runes {
+		if unicode.IsUpper(r) {
+			if i > 0 && (unicode.IsLower(runes[i-1]) || unicode.IsDigit(runes[i-1]) ||
+				(i+1 < len(runes) && unicode.IsUpper(runes[i-1]) && unicode.IsLower(runes[i+1]))) {
+				b.WriteByte('_')
+			}
+			r = unicode.ToLower(r)
+		}
+		b.WriteRune(r)
+	}
+	return b.String()
+}
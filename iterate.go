@@ -0,0 +1,199 @@
+package thirdlib
+
+import (
+	"reflect"
+	"sync"
+	"time"
+
+	"go.starlark.net/starlark"
+)
+
+// cancelPollInterval is how often a blocked channel receive checks whether
+// its thread was cancelled.
+var cancelPollInterval = 10 * time.Millisecond
+
+// Iterate iterates over the keys of a map, the elements of a slice or an
+// array (or a pointer to them), values received from a channel until it is
+// closed, and values yielded by a go iterator function like
+// func(yield func(T) bool), or func(yield func(K, V) bool) yielding tuples.
+// A channel is only iterable when bound to a thread, whose cancellation ends
+// a blocked receive, see Bind.
+func (u *UserValue) Iterate() starlark.Iterator {
+	rvalue := u.rvalue
+	if rvalue.Kind() == reflect.Ptr {
+		if rvalue.IsNil() {
+			return nil
+		}
+		rvalue = rvalue.Elem()
+	}
+	switch rvalue.Kind() {
+	case reflect.Map:
+		return &mapIterator{u: u, keys: u.mapKeys(rvalue)}
+	case reflect.Slice, reflect.Array:
+		return &indexIterator{u: u}
+	case reflect.Chan:
+		if rvalue.Type().ChanDir()&reflect.RecvDir == 0 || u.thread == nil {
+			return nil
+		}
+		return &chanIterator{u: u, ch: rvalue}
+	case reflect.Func:
+		if isSeqFunc(rvalue.Type()) {
+			return newSeqIterator(u, rvalue)
+		}
+	}
+	return nil
+}
+
+// mapIterator iterates over the keys of a map present when it started.
+type mapIterator struct {
+	u    *UserValue
+	keys []reflect.Value
+}
+
+func (it *mapIterator) Next(p *starlark.Value) bool {
+	if len(it.keys) > 0 {
+		*p = it.u.toValue(it.keys[0].Interface())
+		it.keys = it.keys[1:]
+		return true
+	}
+	return false
+}
+
+func (it *mapIterator) Done() {}
+
+type indexIterator struct {
+	u *UserValue
+	i int
+}
+
+func (it *indexIterator) Next(p *starlark.Value) bool {
+	if it.i < it.u.Len() {
+		*p = it.u.Index(it.i)
+		it.i++
+		return true
+	}
+	return false
+}
+
+func (it *indexIterator) Done() {}
+
+type chanIterator struct {
+	u  *UserValue
+	ch reflect.Value
+}
+
+// Next receives the next value, it stops at a closed channel, or when the
+// thread of the value is cancelled while waiting.
+func (it *chanIterator) Next(p *starlark.Value) bool {
+	ticker := time.NewTicker(cancelPollInterval)
+	defer ticker.Stop()
+	cases := []reflect.SelectCase{
+		{Dir: reflect.SelectRecv, Chan: it.ch},
+		{Dir: reflect.SelectRecv, Chan: reflect.ValueOf(ticker.C)},
+	}
+	for {
+		chosen, v, ok := reflect.Select(cases)
+		if chosen == 0 {
+			if !ok {
+				return false
+			}
+			*p = it.u.toValue(v.Interface())
+			return true
+		}
+		if _, cancelled := cancelReason(it.u.thread); cancelled {
+			return false
+		}
+	}
+}
+
+func (it *chanIterator) Done() {}
+
+// UnboundChan wraps a channel which can be received from, but is not bound
+// to a thread, see Bind. ToValue returns it instead of a UserValue for these
+// channels. It is not iterable, as nothing could end a receive blocking
+// forever, and its type names go.bind, which scripts see in the error.
+type UnboundChan struct {
+	u *UserValue
+}
+
+// UserValue returns the UserValue c wraps.
+func (c *UnboundChan) UserValue() *UserValue { return c.u }
+
+// isUnboundChan reports whether u is a channel, or a pointer to one, which
+// could be received from but is not bound to a thread.
+func isUnboundChan(u *UserValue) bool {
+	t := u.rtype
+	if t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	return t.Kind() == reflect.Chan && t.ChanDir()&reflect.RecvDir != 0 && u.thread == nil
+}
+
+func (c *UnboundChan) String() string        { return c.u.String() }
+func (c *UnboundChan) Type() string          { return c.u.Type() + " (unbound, see go.bind)" }
+func (c *UnboundChan) Freeze()               { c.u.Freeze() }
+func (c *UnboundChan) Truth() starlark.Bool  { return c.u.Truth() }
+func (c *UnboundChan) Hash() (uint32, error) { return c.u.Hash() }
+
+func (c *UnboundChan) Attr(name string) (starlark.Value, error) { return c.u.Attr(name) }
+func (c *UnboundChan) AttrNames() []string                      { return c.u.AttrNames() }
+
+// isSeqFunc reports whether t is a go iterator function, like
+// func(yield func(T) bool) or func(yield func(K, V) bool).
+func isSeqFunc(t reflect.Type) bool {
+	if t.NumIn() != 1 || t.NumOut() != 0 {
+		return false
+	}
+	yield := t.In(0)
+	return yield.Kind() == reflect.Func && (yield.NumIn() == 1 || yield.NumIn() == 2) &&
+		yield.NumOut() == 1 && yield.Out(0).Kind() == reflect.Bool
+}
+
+// seqIterator runs a go iterator function in its own goroutine, handing each
+// yielded value over to Next. Done stops the function at its next yield.
+type seqIterator struct {
+	u      *UserValue
+	values chan []reflect.Value
+	stop   chan struct{}
+	once   sync.Once
+}
+
+func newSeqIterator(u *UserValue, fn reflect.Value) *seqIterator {
+	it := &seqIterator{u: u, values: make(chan []reflect.Value), stop: make(chan struct{})}
+	yield := reflect.MakeFunc(fn.Type().In(0), func(args []reflect.Value) []reflect.Value {
+		select {
+		case it.values <- args:
+			return []reflect.Value{reflect.ValueOf(true)}
+		case <-it.stop:
+			return []reflect.Value{reflect.ValueOf(false)}
+		}
+	})
+	go func() {
+		defer close(it.values)
+		// a panic ends the iteration, there is no way to report it
+		defer func() { _ = recover() }()
+		fn.Call([]reflect.Value{yield})
+	}()
+	return it
+}
+
+func (it *seqIterator) Next(p *starlark.Value) bool {
+	select {
+	case args, ok := <-it.values:
+		if !ok {
+			return false
+		}
+		if len(args) == 1 {
+			*p = it.u.toValue(args[0].Interface())
+		} else {
+			*p = starlark.Tuple{it.u.toValue(args[0].Interface()), it.u.toValue(args[1].Interface())}
+		}
+		return true
+	case <-it.stop:
+		return false
+	}
+}
+
+func (it *seqIterator) Done() {
+	it.once.Do(func() { close(it.stop) })
+}
@@ -0,0 +1,245 @@
+package thirdlib
+
+import (
+	"fmt"
+	"reflect"
+	"sort"
+
+	"go.starlark.net/starlark"
+)
+
+// mapMethods are the dict methods of a wrapped go map, go methods of a
+// named map type win over them.
+var mapMethods = map[string]*starlark.Builtin{
+	"clear":      starlark.NewBuiltin("clear", mapClear),
+	"get":        starlark.NewBuiltin("get", mapGet),
+	"items":      starlark.NewBuiltin("items", mapItems),
+	"keys":       starlark.NewBuiltin("keys", mapKeys),
+	"pop":        starlark.NewBuiltin("pop", mapPop),
+	"setdefault": starlark.NewBuiltin("setdefault", mapSetDefault),
+	"update":     starlark.NewBuiltin("update", mapUpdate),
+	"values":     starlark.NewBuiltin("values", mapValues),
+}
+
+// mapping returns the go map wrapped by u, following a pointer to a map.
+func (u *UserValue) mapping() (reflect.Value, bool) {
+	rvalue := u.rvalue
+	if rvalue.Kind() == reflect.Ptr && !rvalue.IsNil() {
+		rvalue = rvalue.Elem()
+	}
+	return rvalue, rvalue.Kind() == reflect.Map
+}
+
+// mapKeys returns the keys of m, sorted if the converter has SortedMapKeys.
+func (u *UserValue) mapKeys(m reflect.Value) []reflect.Value {
+	keys := m.MapKeys()
+	if u.conv.SortedMapKeys {
+		sort.Slice(keys, func(i, j int) bool { return lessMapKey(keys[i], keys[j]) })
+	}
+	return keys
+}
+
+// lessMapKey orders keys of ordered kinds by value, others by their
+// formatted value.
+func lessMapKey(x, y reflect.Value) bool {
+	switch x.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return x.Int() < y.Int()
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		return x.Uint() < y.Uint()
+	case reflect.Float32, reflect.Float64:
+		return x.Float() < y.Float()
+	case reflect.String:
+		return x.String() < y.String()
+	}
+	return fmt.Sprintf("%#v", x.Interface()) < fmt.Sprintf("%#v", y.Interface())
+}
+
+func (u *UserValue) setMapIndex(thread *starlark.Thread, m reflect.Value, k, v starlark.Value) error {
+	if m.IsNil() {
+		return fmt.Errorf("cannot insert into nil map %s", u.Type())
+	}
+	key, err := u.conv.sValueToReflect(thread, k, m.Type().Key())
+	if err != nil {
+		return err
+	}
+	value, err := u.conv.sValueToReflect(thread, v, m.Type().Elem())
+	if err != nil {
+		return err
+	}
+	m.SetMapIndex(key, value)
+	return nil
+}
+
+// mapReceiver returns the receiver of a map method and its map, checking
+// that it could be changed if mutating is set.
+func mapReceiver(b *starlark.Builtin, mutating string) (*UserValue, reflect.Value, error) {
+	u := b.Receiver().(*UserValue)
+	m, _ := u.mapping()
+	if mutating != "" {
+		if err := u.checkMutable(mutating); err != nil {
+			return nil, m, fmt.Errorf("%s: %w", b.Name(), err)
+		}
+	}
+	return u, m, nil
+}
+
+func mapClear(_ *starlark.Thread, b *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (_ starlark.Value, err error) {
+	defer recoverPanic(b.Name(), &err)
+	if err := starlark.UnpackPositionalArgs(b.Name(), args, kwargs, 0); err != nil {
+		return nil, err
+	}
+	_, m, err := mapReceiver(b, "clear")
+	if err != nil {
+		return nil, err
+	}
+	for _, key := range m.MapKeys() {
+		m.SetMapIndex(key, reflect.Value{})
+	}
+	return starlark.None, nil
+}
+
+func mapGet(_ *starlark.Thread, b *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (_ starlark.Value, err error) {
+	var key, dflt starlark.Value = nil, starlark.None
+	if err := starlark.UnpackPositionalArgs(b.Name(), args, kwargs, 1, &key, &dflt); err != nil {
+		return nil, err
+	}
+	u := b.Receiver().(*UserValue)
+	v, found, err := u.Get(key)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", b.Name(), err)
+	}
+	if !found {
+		return dflt, nil
+	}
+	return v, nil
+}
+
+func mapItems(_ *starlark.Thread, b *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+	if err := starlark.UnpackPositionalArgs(b.Name(), args, kwargs, 0); err != nil {
+		return nil, err
+	}
+	items := b.Receiver().(*UserValue).Items()
+	values := make([]starlark.Value, len(items))
+	for i, item := range items {
+		values[i] = item
+	}
+	return starlark.NewList(values), nil
+}
+
+func mapKeys(_ *starlark.Thread, b *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+	if err := starlark.UnpackPositionalArgs(b.Name(), args, kwargs, 0); err != nil {
+		return nil, err
+	}
+	u, m, _ := mapReceiver(b, "")
+	var values []starlark.Value
+	for _, key := range u.mapKeys(m) {
+		values = append(values, u.toValue(key.Interface()))
+	}
+	return starlark.NewList(values), nil
+}
+
+func mapValues(_ *starlark.Thread, b *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+	if err := starlark.UnpackPositionalArgs(b.Name(), args, kwargs, 0); err != nil {
+		return nil, err
+	}
+	u, m, _ := mapReceiver(b, "")
+	var values []starlark.Value
+	for _, key := range u.mapKeys(m) {
+		values = append(values, u.toValue(m.MapIndex(key).Interface()))
+	}
+	return starlark.NewList(values), nil
+}
+
+func mapPop(_ *starlark.Thread, b *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (_ starlark.Value, err error) {
+	defer recoverPanic(b.Name(), &err)
+	var key, dflt starlark.Value
+	if err := starlark.UnpackPositionalArgs(b.Name(), args, kwargs, 1, &key, &dflt); err != nil {
+		return nil, err
+	}
+	u, m, err := mapReceiver(b, "delete from")
+	if err != nil {
+		return nil, err
+	}
+	if k, err := u.conv.sValueToReflect(u.thread, key, m.Type().Key()); err == nil {
+		if v := m.MapIndex(k); v.IsValid() {
+			m.SetMapIndex(k, reflect.Value{})
+			return u.toValue(v.Interface()), nil
+		}
+	}
+	if dflt != nil {
+		return dflt, nil
+	}
+	return nil, fmt.Errorf("%s: missing key %s", b.Name(), key)
+}
+
+func mapSetDefault(thread *starlark.Thread, b *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (_ starlark.Value, err error) {
+	defer recoverPanic(b.Name(), &err)
+	var key, dflt starlark.Value = nil, starlark.None
+	if err := starlark.UnpackPositionalArgs(b.Name(), args, kwargs, 1, &key, &dflt); err != nil {
+		return nil, err
+	}
+	u := b.Receiver().(*UserValue)
+	if v, found, err := u.Get(key); err != nil {
+		return nil, fmt.Errorf("%s: %w", b.Name(), err)
+	} else if found {
+		return v, nil
+	}
+	_, m, err := mapReceiver(b, "insert into")
+	if err != nil {
+		return nil, err
+	}
+	if err := u.setMapIndex(thread, m, key, dflt); err != nil {
+		return nil, fmt.Errorf("%s: %w", b.Name(), err)
+	}
+	return dflt, nil
+}
+
+// mapUpdate updates the map like dict.update, from a mapping or an iterable
+// of pairs, then from keyword arguments.
+func mapUpdate(thread *starlark.Thread, b *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (_ starlark.Value, err error) {
+	defer recoverPanic(b.Name(), &err)
+	if len(args) > 1 {
+		return nil, fmt.Errorf("%s: got %d arguments, want at most 1", b.Name(), len(args))
+	}
+	u, m, err := mapReceiver(b, "insert into")
+	if err != nil {
+		return nil, err
+	}
+	var pairs []starlark.Tuple
+	if len(args) == 1 {
+		switch other := args[0].(type) {
+		case starlark.IterableMapping:
+			pairs = other.Items()
+		case starlark.Iterable:
+			iter := other.Iterate()
+			defer iter.Done()
+			var x starlark.Value
+			for i := 0; iter.Next(&x); i++ {
+				pair, ok := x.(starlark.Tuple)
+				if !ok {
+					if list, isList := x.(*starlark.List); isList {
+						pair = make(starlark.Tuple, list.Len())
+						for j := range pair {
+							pair[j] = list.Index(j)
+						}
+						ok = true
+					}
+				}
+				if !ok || len(pair) != 2 {
+					return nil, fmt.Errorf("%s: element #%d is not a pair", b.Name(), i)
+				}
+				pairs = append(pairs, pair)
+			}
+		default:
+			return nil, fmt.Errorf("%s: got %s, want iterable", b.Name(), args[0].Type())
+		}
+	}
+	pairs = append(pairs, kwargs...)
+	for _, pair := range pairs {
+		if err := u.setMapIndex(thread, m, pair[0], pair[1]); err != nil {
+			return nil, fmt.Errorf("%s: %w", b.Name(), err)
+		}
+	}
+	return starlark.None, nil
+}
@@ -0,0 +1,107 @@
+package thirdlib
+
+import (
+	"math"
+	"math/big"
+	"reflect"
+
+	"go.starlark.net/starlark"
+)
+
+var (
+	refTypeBigInt   = reflect.TypeOf((*big.Int)(nil))
+	refTypeBigFloat = reflect.TypeOf((*big.Float)(nil))
+)
+
+// bigToStarlark converts a *big.Int to an Int and a *big.Float to a Float,
+// ok is false for other values.
+func bigToStarlark(v reflect.Value) (_ starlark.Value, ok bool) {
+	if !v.IsValid() || !v.CanInterface() {
+		return nil, false
+	}
+	switch x := v.Interface().(type) {
+	case *big.Int:
+		if x == nil {
+			return starlark.None, true
+		}
+		return starlark.MakeBigInt(new(big.Int).Set(x)), true
+	case *big.Float:
+		if x == nil {
+			return starlark.None, true
+		}
+		f, _ := x.Float64()
+		return starlark.Float(f), true
+	}
+	return nil, false
+}
+
+// intToReflect converts an Int to a go integer or float of type hint, an
+// integer out of the range of hint is an error. Other types, like named
+// interfaces, get an int, or a *big.Int if it does not fit.
+func intToReflect(v starlark.Int, hint reflect.Type) (reflect.Value, error) {
+	switch hint.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		i, ok := v.Int64()
+		if !ok || reflect.Zero(hint).OverflowInt(i) {
+			return reflect.Value{}, conversionError{Value: v, Hint: hint, Overflow: true}
+		}
+		val := reflect.New(hint).Elem()
+		val.SetInt(i)
+		return val, nil
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		u, ok := v.Uint64()
+		if !ok || reflect.Zero(hint).OverflowUint(u) {
+			return reflect.Value{}, conversionError{Value: v, Hint: hint, Overflow: true}
+		}
+		val := reflect.New(hint).Elem()
+		val.SetUint(u)
+		return val, nil
+	case reflect.Float32, reflect.Float64:
+		f := v.Float()
+		if reflect.Zero(hint).OverflowFloat(float64(f)) {
+			return reflect.Value{}, conversionError{Value: v, Hint: hint, Overflow: true}
+		}
+		val := reflect.New(hint).Elem()
+		val.SetFloat(float64(f))
+		return val, nil
+	}
+	switch {
+	case hint == refTypeBigInt:
+		return reflect.ValueOf(v.BigInt()), nil
+	case hint == refTypeBigFloat:
+		return reflect.ValueOf(new(big.Float).SetInt(v.BigInt())), nil
+	}
+	val := reflect.ValueOf(v.BigInt())
+	if i, ok := v.Int64(); ok && int64(int(i)) == i {
+		val = reflect.ValueOf(int(i))
+	}
+	if !convertible(val.Type(), hint) {
+		return reflect.Value{}, conversionError{Value: v, Hint: hint}
+	}
+	return val.Convert(hint), nil
+}
+
+// floatToReflect converts a Float to a go float of type hint, a finite
+// value out of the range of hint is an error.
+func floatToReflect(v starlark.Float, hint reflect.Type) (reflect.Value, error) {
+	f := float64(v)
+	switch {
+	case hint.Kind() == reflect.Float32 || hint.Kind() == reflect.Float64:
+		if !math.IsInf(f, 0) && reflect.Zero(hint).OverflowFloat(f) {
+			return reflect.Value{}, conversionError{Value: v, Hint: hint, Overflow: true}
+		}
+		val := reflect.New(hint).Elem()
+		val.SetFloat(f)
+		return val, nil
+	case hint == refTypeBigFloat:
+		if math.IsNaN(f) {
+			return reflect.Value{}, conversionError{Value: v, Hint: hint}
+		}
+		return reflect.ValueOf(big.NewFloat(f)), nil
+	}
+	val := reflect.ValueOf(f)
+	if !convertible(val.Type(), hint) {
+		return reflect.Value{}, conversionError{Value: v, Hint: hint}
+	}
+	return val.Convert(hint), nil
+}
@@ -0,0 +1,279 @@
+package thirdlib
+
+import (
+	"fmt"
+	"math"
+	"math/bits"
+	"reflect"
+
+	"go.starlark.net/starlark"
+	"go.starlark.net/syntax"
+)
+
+// binaryMethods are the conventional go methods implementing an operator,
+// either as x.Add(y) or, like math/big, as z.Add(x, y).
+var binaryMethods = map[syntax.Token][]string{
+	syntax.PLUS:       {"Add"},
+	syntax.MINUS:      {"Sub"},
+	syntax.STAR:       {"Mul"},
+	syntax.SLASH:      {"Quo", "Div"},
+	syntax.SLASHSLASH: {"Div"},
+	syntax.PERCENT:    {"Mod", "Rem"},
+}
+
+// Binary implements arithmetic on numeric go kinds, like time.Duration, and
+// dispatches other values to their Add, Sub, Mul, Quo, Div, Mod or Rem
+// method. The other operand is converted to the go type expected.
+func (u *UserValue) Binary(op syntax.Token, y starlark.Value, side starlark.Side) (_ starlark.Value, err error) {
+	defer recoverPanic(u.Type()+" "+op.String(), &err)
+	if isNumeric(u.rtype.Kind()) {
+		return u.numericBinary(op, y, side)
+	}
+	for _, name := range binaryMethods[op] {
+		if v, ok, err := u.methodBinary(name, y, side); ok || err != nil {
+			return v, err
+		}
+	}
+	return nil, nil // unhandled
+}
+
+// Unary implements -, + and ~ on numeric go kinds, and dispatches - to the
+// Neg method of other values.
+func (u *UserValue) Unary(op syntax.Token) (_ starlark.Value, err error) {
+	defer recoverPanic(u.Type()+" "+op.String(), &err)
+	if isNumeric(u.rtype.Kind()) {
+		x, result := u.rvalue, reflect.New(u.rtype).Elem()
+		switch {
+		case op == syntax.PLUS:
+			return u, nil
+		case op == syntax.MINUS && isInt(x.Kind()):
+			if x.Int() == math.MinInt64 || result.OverflowInt(-x.Int()) {
+				return nil, fmt.Errorf("%s overflow", u.Type())
+			}
+			result.SetInt(-x.Int())
+		case op == syntax.MINUS && isFloat(x.Kind()):
+			result.SetFloat(-x.Float())
+		case op == syntax.TILDE && isInt(x.Kind()):
+			result.SetInt(^x.Int())
+		case op == syntax.TILDE && isUint(x.Kind()):
+			result.SetUint(^x.Uint())
+		default:
+			return nil, nil
+		}
+		return u.conv.newUserValue(result.Interface(), u.thread), nil
+	}
+	if op != syntax.MINUS {
+		return nil, nil
+	}
+	m, ok := u.rtype.MethodByName("Neg")
+	if !ok {
+		return nil, nil
+	}
+	switch ft := m.Type; {
+	case ft.NumIn() == 1 && ft.NumOut() >= 1:
+		return u.operatorResults(m.Func.Call([]reflect.Value{u.rvalue}))
+	case ft.NumIn() == 2 && ft.In(1) == u.rtype && u.rtype.Kind() == reflect.Ptr:
+		z := reflect.New(u.rtype.Elem())
+		return u.operatorResults(m.Func.Call([]reflect.Value{z, u.rvalue}))
+	}
+	return nil, nil
+}
+
+func (u *UserValue) numericBinary(op syntax.Token, y starlark.Value, side starlark.Side) (starlark.Value, error) {
+	var other reflect.Value
+	switch y := y.(type) {
+	case *UserValue:
+		if y.rtype != u.rtype {
+			return nil, nil
+		}
+		other = y.rvalue
+	case starlark.Int, starlark.Float:
+		v, err := u.conv.sValueToReflect(u.thread, y, u.rtype)
+		if err != nil {
+			return nil, nil
+		}
+		other = v
+	default:
+		return nil, nil
+	}
+	x := u.rvalue
+	if side == starlark.Right {
+		x, other = other, x
+	}
+
+	result := reflect.New(u.rtype).Elem()
+	switch kind := u.rtype.Kind(); {
+	case isInt(kind):
+		a, b := x.Int(), other.Int()
+		var r int64
+		var overflow bool
+		switch op {
+		case syntax.PLUS:
+			r, overflow = addInt64(a, b)
+		case syntax.MINUS:
+			r, overflow = subInt64(a, b)
+		case syntax.STAR:
+			r, overflow = mulInt64(a, b)
+		case syntax.SLASHSLASH, syntax.PERCENT:
+			if b == 0 {
+				return nil, fmt.Errorf("integer division by zero")
+			}
+			if a == math.MinInt64 && b == -1 {
+				// the quotient does not fit, the remainder is 0
+				overflow = op == syntax.SLASHSLASH
+				break
+			}
+			// floored like starlark ints
+			q, m := a/b, a%b
+			if m != 0 && (m < 0) != (b < 0) {
+				q, m = q-1, m+b
+			}
+			if r = q; op == syntax.PERCENT {
+				r = m
+			}
+		default:
+			return nil, nil
+		}
+		if overflow || result.OverflowInt(r) {
+			return nil, fmt.Errorf("%s overflow", u.Type())
+		}
+		result.SetInt(r)
+	case isUint(kind):
+		a, b := x.Uint(), other.Uint()
+		var r, carry uint64
+		switch op {
+		case syntax.PLUS:
+			r, carry = bits.Add64(a, b, 0)
+		case syntax.MINUS:
+			r, carry = bits.Sub64(a, b, 0)
+		case syntax.STAR:
+			carry, r = bits.Mul64(a, b)
+		case syntax.SLASHSLASH, syntax.PERCENT:
+			if b == 0 {
+				return nil, fmt.Errorf("integer division by zero")
+			}
+			if r = a / b; op == syntax.PERCENT {
+				r = a % b
+			}
+		default:
+			return nil, nil
+		}
+		if carry != 0 || result.OverflowUint(r) {
+			return nil, fmt.Errorf("%s overflow", u.Type())
+		}
+		result.SetUint(r)
+	case isFloat(kind):
+		a, b := x.Float(), other.Float()
+		switch op {
+		case syntax.PLUS:
+			result.SetFloat(a + b)
+		case syntax.MINUS:
+			result.SetFloat(a - b)
+		case syntax.STAR:
+			result.SetFloat(a * b)
+		case syntax.SLASH:
+			if b == 0 {
+				return nil, fmt.Errorf("floating-point division by zero")
+			}
+			result.SetFloat(a / b)
+		default:
+			return nil, nil
+		}
+	}
+	return u.conv.newUserValue(result.Interface(), u.thread), nil
+}
+
+// methodBinary calls the method name implementing a binary operator, ok
+// reports whether u has a method of a known shape accepting y.
+func (u *UserValue) methodBinary(name string, y starlark.Value, side starlark.Side) (_ starlark.Value, ok bool, err error) {
+	m, found := u.rtype.MethodByName(name)
+	if !found {
+		return nil, false, nil
+	}
+	switch ft := m.Type; {
+	case ft.NumIn() == 2 && ft.NumOut() >= 1:
+		// x.Add(y)
+		other, err := u.conv.sValueToReflect(u.thread, y, ft.In(1))
+		if err != nil {
+			return nil, false, nil
+		}
+		args := []reflect.Value{u.rvalue, other}
+		if side == starlark.Right {
+			if ft.In(1) != u.rtype {
+				return nil, false, nil
+			}
+			args[0], args[1] = other, u.rvalue
+		}
+		v, err := u.operatorResults(m.Func.Call(args))
+		return v, true, err
+	case ft.NumIn() == 3 && ft.In(1) == u.rtype && ft.In(2) == u.rtype && u.rtype.Kind() == reflect.Ptr:
+		// z.Add(x, y)
+		other, err := u.conv.sValueToReflect(u.thread, y, u.rtype)
+		if err != nil {
+			return nil, false, nil
+		}
+		x, yv := u.rvalue, other
+		if side == starlark.Right {
+			x, yv = yv, x
+		}
+		z := reflect.New(u.rtype.Elem())
+		v, err := u.operatorResults(m.Func.Call([]reflect.Value{z, x, yv}))
+		return v, true, err
+	}
+	return nil, false, nil
+}
+
+// operatorResults converts the results of an operator method, a trailing
+// non-nil error is returned as error.
+func (u *UserValue) operatorResults(results []reflect.Value) (starlark.Value, error) {
+	if n := len(results); n > 1 && results[n-1].Type() == refTypeError {
+		if !results[n-1].IsNil() {
+			return nil, results[n-1].Interface().(error)
+		}
+	}
+	return u.toValueWithThread(results[0].Interface(), u.thread), nil
+}
+
+// compareMethod orders u and other with a Cmp method returning an int, like
+// the one of big.Int.
+func (u *UserValue) compareMethod(other *UserValue) (int, bool) {
+	m, ok := u.rtype.MethodByName("Cmp")
+	if !ok || m.Type.NumIn() != 2 || m.Type.In(1) != u.rtype || m.Type.NumOut() != 1 || !isInt(m.Type.Out(0).Kind()) {
+		return 0, false
+	}
+	return int(m.Func.Call([]reflect.Value{u.rvalue, other.rvalue})[0].Int()), true
+}
+
+func isInt(k reflect.Kind) bool {
+	return k >= reflect.Int && k <= reflect.Int64
+}
+
+func isUint(k reflect.Kind) bool {
+	return k >= reflect.Uint && k <= reflect.Uintptr
+}
+
+func isFloat(k reflect.Kind) bool {
+	return k == reflect.Float32 || k == reflect.Float64
+}
+
+func isNumeric(k reflect.Kind) bool {
+	return isInt(k) || isUint(k) || isFloat(k)
+}
+
+// addInt64, subInt64 and mulInt64 report whether the result overflows int64
+// before it wraps.
+func addInt64(a, b int64) (int64, bool) {
+	return a + b, b > 0 && a > math.MaxInt64-b || b < 0 && a < math.MinInt64-b
+}
+
+func subInt64(a, b int64) (int64, bool) {
+	return a - b, b < 0 && a > math.MaxInt64+b || b > 0 && a < math.MinInt64+b
+}
+
+func mulInt64(a, b int64) (int64, bool) {
+	if a == 0 || b == 0 {
+		return 0, false
+	}
+	r := a * b
+	return r, r/b != a || a == -1 && b == math.MinInt64 || b == -1 && a == math.MinInt64
+}
@@ -0,0 +1,121 @@
+package thirdlib
+
+import (
+	"reflect"
+
+	"go.starlark.net/starlark"
+	"go.starlark.net/syntax"
+)
+
+// Sequence wraps a go slice or array, or a pointer to one, like a starlark
+// list. ToValue returns it instead of a UserValue for these values. Unlike
+// UserValue it is not a starlark.Mapping, which the interpreter asks first,
+// so x[i] is an index and `x in s` looks for an element instead of an index.
+type Sequence struct {
+	u *UserValue
+}
+
+// UserValue returns the UserValue s wraps.
+func (s *Sequence) UserValue() *UserValue { return s.u }
+
+// GoValue returns the go value wrapped by v, a *UserValue, a *Sequence or an
+// *UnboundChan, including changes made by the script.
+func GoValue(v starlark.Value) (interface{}, bool) {
+	if u, ok := asUserValue(v); ok {
+		return u.goValue(), true
+	}
+	return nil, false
+}
+
+var (
+	_ starlark.Indexable   = (*Sequence)(nil)
+	_ starlark.HasSetIndex = (*Sequence)(nil)
+	_ starlark.Sliceable   = (*Sequence)(nil)
+	_ starlark.Iterable    = (*Sequence)(nil)
+	_ starlark.HasAttrs    = (*Sequence)(nil)
+	_ starlark.HasBinary   = (*Sequence)(nil)
+	_ starlark.Comparable  = (*Sequence)(nil)
+)
+
+// isSequence reports whether values of t are wrapped as Sequence.
+func isSequence(t reflect.Type) bool {
+	switch t.Kind() {
+	case reflect.Slice, reflect.Array, reflect.String:
+		return true
+	case reflect.Ptr:
+		// not *string, which Len, Index and Slice do not follow
+		return t.Elem().Kind() == reflect.Slice || t.Elem().Kind() == reflect.Array
+	}
+	return false
+}
+
+// starlarkValue returns u as seen by scripts, a Sequence for sequences, an
+// UnboundChan for channels not bound to a thread.
+func (u *UserValue) starlarkValue() starlark.Value {
+	if isSequence(u.rtype) {
+		return &Sequence{u: u}
+	}
+	if isUnboundChan(u) {
+		return &UnboundChan{u: u}
+	}
+	return u
+}
+
+// asUserValue returns the UserValue wrapped by v, if any.
+func asUserValue(v starlark.Value) (*UserValue, bool) {
+	switch v := v.(type) {
+	case *UserValue:
+		return v, true
+	case *Sequence:
+		return v.u, true
+	case *UnboundChan:
+		return v.u, true
+	}
+	return nil, false
+}
+
+func (s *Sequence) String() string        { return s.u.String() }
+func (s *Sequence) Type() string          { return s.u.Type() }
+func (s *Sequence) Freeze()               { s.u.Freeze() }
+func (s *Sequence) Truth() starlark.Bool  { return s.u.Truth() }
+func (s *Sequence) Hash() (uint32, error) { return s.u.Hash() }
+
+func (s *Sequence) Index(i int) starlark.Value { return s.u.Index(i) }
+func (s *Sequence) Len() int                   { return s.u.Len() }
+
+func (s *Sequence) SetIndex(i int, v starlark.Value) error { return s.u.SetIndex(i, v) }
+
+func (s *Sequence) Slice(start, end, step int) starlark.Value {
+	return s.u.Slice(start, end, step)
+}
+
+func (s *Sequence) Iterate() starlark.Iterator { return s.u.Iterate() }
+
+func (s *Sequence) Attr(name string) (starlark.Value, error) { return s.u.Attr(name) }
+func (s *Sequence) AttrNames() []string                      { return s.u.AttrNames() }
+
+func (s *Sequence) CompareSameType(op syntax.Token, y starlark.Value, depth int) (bool, error) {
+	other, _ := asUserValue(y)
+	return s.u.CompareSameType(op, other, depth)
+}
+
+// Binary implements `x in s` by comparing x to the elements of s, other
+// operators are those of UserValue.
+func (s *Sequence) Binary(op syntax.Token, y starlark.Value, side starlark.Side) (_ starlark.Value, err error) {
+	if op != syntax.IN || side != starlark.Right {
+		return s.u.Binary(op, y, side)
+	}
+	defer recoverPanic(s.Type()+" in", &err)
+	if str, ok := s.u.sequence(); ok && str.Kind() == reflect.String {
+		// like `in` of a starlark string, a substring test
+		return starlark.Binary(syntax.IN, y, starlark.String(str.String()))
+	}
+	for i, n := 0, s.u.Len(); i < n; i++ {
+		if eq, err := starlark.Equal(s.u.Index(i), y); err != nil {
+			return nil, err
+		} else if eq {
+			return starlark.True, nil
+		}
+	}
+	return starlark.False, nil
+}
@@ -0,0 +1,173 @@
+package thirdlib
+
+import (
+	"fmt"
+	"reflect"
+
+	"go.starlark.net/starlark"
+)
+
+// sliceMethods are the list methods of a wrapped go slice, go methods of a
+// named slice type win over them.
+var sliceMethods = map[string]*starlark.Builtin{
+	"append": starlark.NewBuiltin("append", sliceAppend),
+	"clear":  starlark.NewBuiltin("clear", sliceClear),
+	"extend": starlark.NewBuiltin("extend", sliceExtend),
+	"insert": starlark.NewBuiltin("insert", sliceInsert),
+	"pop":    starlark.NewBuiltin("pop", slicePop),
+}
+
+// slice returns the go slice wrapped by u, following a pointer to a slice.
+func (u *UserValue) slice() (reflect.Value, bool) {
+	rvalue := u.rvalue
+	if rvalue.Kind() == reflect.Ptr && !rvalue.IsNil() {
+		rvalue = rvalue.Elem()
+	}
+	return rvalue, rvalue.Kind() == reflect.Slice
+}
+
+// setSlice replaces the slice wrapped by u with s. The go variable behind a
+// pointer to a slice is updated, a slice value only changes for u.
+func (u *UserValue) setSlice(s reflect.Value) {
+	if u.rvalue.Kind() == reflect.Ptr {
+		u.rvalue.Elem().Set(s)
+		return
+	}
+	if u.rvalue.CanSet() {
+		u.rvalue.Set(s)
+		return
+	}
+	u.rvalue = s
+	u.value = s.Interface()
+}
+
+// sliceReceiver returns the receiver of a list method and its slice, checking
+// that it could be changed.
+func sliceReceiver(b *starlark.Builtin, verb string) (*UserValue, reflect.Value, error) {
+	u := b.Receiver().(*UserValue)
+	s, _ := u.slice()
+	if err := u.checkMutable(verb); err != nil {
+		return nil, s, fmt.Errorf("%s: %w", b.Name(), err)
+	}
+	return u, s, nil
+}
+
+// elem converts v to an element of the slice s for the calling thread.
+func (u *UserValue) elem(thread *starlark.Thread, b *starlark.Builtin, s reflect.Value, v starlark.Value) (reflect.Value, error) {
+	elem, err := u.conv.sValueToReflect(thread, v, s.Type().Elem())
+	if err != nil {
+		return reflect.Value{}, fmt.Errorf("%s: %w", b.Name(), err)
+	}
+	return elem, nil
+}
+
+func sliceAppend(thread *starlark.Thread, b *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (_ starlark.Value, err error) {
+	defer recoverPanic(b.Name(), &err)
+	var x starlark.Value
+	if err := starlark.UnpackPositionalArgs(b.Name(), args, kwargs, 1, &x); err != nil {
+		return nil, err
+	}
+	u, s, err := sliceReceiver(b, "append to")
+	if err != nil {
+		return nil, err
+	}
+	elem, err := u.elem(thread, b, s, x)
+	if err != nil {
+		return nil, err
+	}
+	u.setSlice(reflect.Append(s, elem))
+	return starlark.None, nil
+}
+
+func sliceClear(_ *starlark.Thread, b *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (_ starlark.Value, err error) {
+	defer recoverPanic(b.Name(), &err)
+	if err := starlark.UnpackPositionalArgs(b.Name(), args, kwargs, 0); err != nil {
+		return nil, err
+	}
+	u, s, err := sliceReceiver(b, "clear")
+	if err != nil {
+		return nil, err
+	}
+	u.setSlice(s.Slice(0, 0))
+	return starlark.None, nil
+}
+
+func sliceExtend(thread *starlark.Thread, b *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (_ starlark.Value, err error) {
+	defer recoverPanic(b.Name(), &err)
+	var iterable starlark.Iterable
+	if err := starlark.UnpackPositionalArgs(b.Name(), args, kwargs, 1, &iterable); err != nil {
+		return nil, err
+	}
+	u, s, err := sliceReceiver(b, "extend")
+	if err != nil {
+		return nil, err
+	}
+	// convert every element first, so a failed conversion leaves s unchanged
+	var elems []reflect.Value
+	iter := iterable.Iterate()
+	defer iter.Done()
+	var x starlark.Value
+	for iter.Next(&x) {
+		elem, err := u.elem(thread, b, s, x)
+		if err != nil {
+			return nil, err
+		}
+		elems = append(elems, elem)
+	}
+	u.setSlice(reflect.Append(s, elems...))
+	return starlark.None, nil
+}
+
+func sliceInsert(thread *starlark.Thread, b *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (_ starlark.Value, err error) {
+	defer recoverPanic(b.Name(), &err)
+	var index int
+	var x starlark.Value
+	if err := starlark.UnpackPositionalArgs(b.Name(), args, kwargs, 2, &index, &x); err != nil {
+		return nil, err
+	}
+	u, s, err := sliceReceiver(b, "insert into")
+	if err != nil {
+		return nil, err
+	}
+	elem, err := u.elem(thread, b, s, x)
+	if err != nil {
+		return nil, err
+	}
+	// like list.insert, the index is clamped
+	n := s.Len()
+	if index < 0 {
+		index += n
+	}
+	if index < 0 {
+		index = 0
+	} else if index > n {
+		index = n
+	}
+	grown := reflect.Append(s, reflect.Zero(s.Type().Elem()))
+	reflect.Copy(grown.Slice(index+1, n+1), grown.Slice(index, n))
+	grown.Index(index).Set(elem)
+	u.setSlice(grown)
+	return starlark.None, nil
+}
+
+func slicePop(_ *starlark.Thread, b *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (_ starlark.Value, err error) {
+	defer recoverPanic(b.Name(), &err)
+	var index starlark.Value = starlark.MakeInt(-1)
+	if err := starlark.UnpackPositionalArgs(b.Name(), args, kwargs, 0, &index); err != nil {
+		return nil, err
+	}
+	u, s, err := sliceReceiver(b, "pop from")
+	if err != nil {
+		return nil, err
+	}
+	i, err := sequenceIndex(index, s.Len())
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", b.Name(), err)
+	}
+	popped := u.toValue(s.Index(i).Interface())
+	n := s.Len()
+	reflect.Copy(s.Slice(i, n-1), s.Slice(i+1, n))
+	s.Index(n - 1).Set(reflect.Zero(s.Type().Elem()))
+	u.setSlice(s.Slice(0, n-1))
+	return popped, nil
+}
@@ -0,0 +1,102 @@
+package thirdlib
+
+import (
+	"encoding"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"time"
+
+	"go.starlark.net/starlark"
+	"go.starlark.net/starlarkstruct"
+)
+
+var (
+	refTypeTextUnmarshaler = reflect.TypeOf((*encoding.TextUnmarshaler)(nil)).Elem()
+	refTypeJSONUnmarshaler = reflect.TypeOf((*json.Unmarshaler)(nil)).Elem()
+)
+
+// unmarshalTo builds a value of type hint with an unmarshaler: a string is
+// parsed as a time.Duration or by encoding.TextUnmarshaler, dicts, lists,
+// tuples and structs are passed to json.Unmarshaler as JSON. ok is false if
+// hint has none of them.
+func (c *Converter) unmarshalTo(v starlark.Value, hint reflect.Type) (_ reflect.Value, ok bool, err error) {
+	s, isString := v.(starlark.String)
+	if isString && hint == refTypeDuration {
+		d, err := time.ParseDuration(string(s))
+		if err != nil {
+			return reflect.Value{}, true, conversionError{Value: v, Hint: hint, Err: err}
+		}
+		return reflect.ValueOf(d), true, nil
+	}
+	if isString {
+		if target, value, found := unmarshalerTarget(hint, refTypeTextUnmarshaler); found {
+			if err := target.Interface().(encoding.TextUnmarshaler).UnmarshalText([]byte(s)); err != nil {
+				return reflect.Value{}, true, conversionError{Value: v, Hint: hint, Err: err}
+			}
+			return value, true, nil
+		}
+	}
+	switch v.(type) {
+	case *starlark.Dict, *starlark.List, starlark.Tuple, *starlarkstruct.Struct:
+	default:
+		return reflect.Value{}, false, nil
+	}
+	if target, value, found := unmarshalerTarget(hint, refTypeJSONUnmarshaler); found {
+		x, err := c.toAny(v, map[starlark.Value]bool{})
+		if err != nil {
+			return reflect.Value{}, true, err
+		}
+		data, err := json.Marshal(x)
+		if err != nil {
+			return reflect.Value{}, true, conversionError{Value: v, Hint: hint, Err: err}
+		}
+		if err := target.Interface().(json.Unmarshaler).UnmarshalJSON(data); err != nil {
+			return reflect.Value{}, true, conversionError{Value: v, Hint: hint, Err: err}
+		}
+		return value, true, nil
+	}
+	return reflect.Value{}, false, nil
+}
+
+// unmarshalerTarget returns a new pointer implementing iface to unmarshal
+// into, and the value of type hint it fills in, for a hint implementing
+// iface itself, as a pointer, or through a pointer receiver.
+func unmarshalerTarget(hint, iface reflect.Type) (target, value reflect.Value, ok bool) {
+	switch {
+	case hint.Kind() == reflect.Ptr && hint.Implements(iface):
+		target = reflect.New(hint.Elem())
+		return target, target, true
+	case hint.Kind() != reflect.Interface && reflect.PtrTo(hint).Implements(iface):
+		target = reflect.New(hint)
+		return target, target.Elem(), true
+	}
+	return reflect.Value{}, reflect.Value{}, false
+}
+
+// marshalText converts a value implementing encoding.TextMarshaler, or else
+// fmt.Stringer, to a String if the converter has TextMarshalers. It is the
+// fallback after the built-in mappings, values of bool, numeric and string
+// kinds, like time.Duration, keep theirs.
+func (c *Converter) marshalText(v reflect.Value) (_ starlark.Value, ok bool, err error) {
+	if !c.TextMarshalers || !v.IsValid() || !v.CanInterface() {
+		return nil, false, nil
+	}
+	if k := v.Kind(); k == reflect.Bool || k == reflect.String || isNumeric(k) {
+		return nil, false, nil
+	}
+	if (v.Kind() == reflect.Ptr || v.Kind() == reflect.Interface) && v.IsNil() {
+		return nil, false, nil
+	}
+	switch x := v.Interface().(type) {
+	case encoding.TextMarshaler:
+		text, err := x.MarshalText()
+		if err != nil {
+			return nil, true, fmt.Errorf("%s: %w", v.Type(), err)
+		}
+		return starlark.String(text), true, nil
+	case fmt.Stringer:
+		return starlark.String(x.String()), true, nil
+	}
+	return nil, false, nil
+}
@@ -3,112 +3,134 @@ package thirdlib
 import (
 	"fmt"
 	"reflect"
+	"time"
 
+	startime "go.starlark.net/lib/time"
 	"go.starlark.net/starlark"
+	"go.starlark.net/starlarkstruct"
 )
 
-var gThread *starlark.Thread
-
-// only for decode, userValue not included in return types
+// DecodeValue converts a go value to native starlark values, like
+// ToStarlark, for go code producing values without UserValue wrapping. It
+// returns None if the value can not be converted.
+//
+// Deprecated: use ToStarlark, which reports why a value could not be
+// converted.
 func DecodeValue(value interface{}) starlark.Value {
-	switch converted := value.(type) {
-	case bool:
-		return starlark.Bool(converted)
-	case float64:
-		return starlark.Float(converted)
-	case string:
-		return starlark.String(converted)
-	case int64:
-		return starlark.MakeInt(int(converted))
-	case int:
-		return starlark.MakeInt(converted)
-	case int8:
-		return starlark.MakeInt(int(converted))
-	case int32:
-		return starlark.MakeInt(int(converted))
-	case int16:
-		return starlark.MakeInt(int(converted))
-	case uint64:
-		return starlark.MakeUint(uint(converted))
-	case uint:
-		return starlark.MakeUint(converted)
-	case uint8:
-		return starlark.MakeUint(uint(converted))
-	case uint32:
-		return starlark.MakeUint(uint(converted))
-	case uint16:
-		return starlark.MakeUint(uint(converted))
-	case []interface{}:
-		var values []starlark.Value
-		for _, item := range converted {
-			values = append(values, DecodeValue(item))
-		}
-		return starlark.NewList(values)
-	case *[]interface{}:
-		if converted == nil {
-			return starlark.None
-		}
-		var values []starlark.Value
-		for _, item := range *converted {
-			values = append(values, DecodeValue(item))
-		}
-		return starlark.NewList(values)
-	case map[string]interface{}:
-		d := starlark.NewDict(len(converted))
-		for key, item := range converted {
-			_ = d.SetKey(DecodeValue(key), DecodeValue(item))
-		}
-		return d
-	case *map[string]interface{}:
-		if converted == nil {
-			return starlark.None
-		}
-		d := starlark.NewDict(len(*converted))
-		for key, item := range *converted {
-			_ = d.SetKey(DecodeValue(key), DecodeValue(item))
-		}
-		return d
-	case nil:
+	return DefaultConverter.DecodeValue(value)
+}
+
+// DecodeValue is like the package level DecodeValue, using the marshalers
+// registered to c.
+//
+// Deprecated: use ToStarlark.
+func (c *Converter) DecodeValue(value interface{}) starlark.Value {
+	v, err := c.ToStarlark(value)
+	if err != nil {
 		return starlark.None
 	}
-	return starlark.None
+	return v
+}
+
+// ToValue converts a go value to a starlark value, values without a starlark
+// counterpart are wrapped as UserValue, Sequence for slices and arrays, or
+// UnboundChan for channels, GoValue unwraps them. It is meant for values created before any script
+// runs, like module members, use ToValueWithThread for values created while
+// a thread is running.
+func ToValue(value interface{}, opts ...Option) starlark.Value {
+	return DefaultConverter.ToValueWithThread(value, nil, opts...)
+}
+
+// ToValueWithThread is like ToValue, the wrapped values are bound to thread,
+// which runs the starlark callbacks created when setting their fields, keys
+// or elements.
+func ToValueWithThread(value interface{}, thread *starlark.Thread, opts ...Option) starlark.Value {
+	return DefaultConverter.ToValueWithThread(value, thread, opts...)
+}
+
+// ToValue is like the package level ToValue, using the marshalers registered
+// to c. It panics if a marshaler fails, see TryToValue.
+func (c *Converter) ToValue(value interface{}, opts ...Option) starlark.Value {
+	return c.ToValueWithThread(value, nil, opts...)
+}
+
+// ToValueWithThread is like the package level ToValueWithThread, using the
+// marshalers registered to c. It panics if a marshaler fails, see
+// TryToValue.
+func (c *Converter) ToValueWithThread(value interface{}, thread *starlark.Thread, opts ...Option) starlark.Value {
+	v, err := c.TryToValue(value, thread, opts...)
+	if err != nil {
+		panic(err)
+	}
+	return v
+}
+
+// TryToValue is like ToValueWithThread, returning the error of a failing
+// marshaler instead of panicking.
+func (c *Converter) TryToValue(value interface{}, thread *starlark.Thread, opts ...Option) (starlark.Value, error) {
+	v, err := c.toValue(value, thread)
+	if err != nil {
+		return nil, err
+	}
+	if u, ok := asUserValue(v); ok {
+		for _, opt := range opts {
+			opt(u)
+		}
+	}
+	return v, nil
 }
 
-func ToValue(value interface{}) starlark.Value {
+func (c *Converter) toValue(value interface{}, thread *starlark.Thread) (starlark.Value, error) {
 	if value == nil {
-		return starlark.None
+		return starlark.None, nil
 	}
 	if val, ok := value.(starlark.Value); ok {
-		return val
+		return val, nil
+	}
+	if v, ok, err := c.marshal(reflect.ValueOf(value)); ok || err != nil {
+		return v, err
+	}
+	if val := reflect.ValueOf(value); c.KeepNamedNumbers && val.Type().PkgPath() != "" && isNumeric(val.Kind()) {
+		return c.newUserValue(value, thread), nil
+	}
+	if v, ok := bigToStarlark(reflect.ValueOf(value)); ok {
+		return v, nil
+	}
+	if v, ok, err := c.marshalText(reflect.ValueOf(value)); ok || err != nil {
+		return v, err
+	}
+	if c.StructRecords && isStruct(reflect.ValueOf(value)) {
+		return c.toRecord(value, thread)
 	}
 	switch val := reflect.ValueOf(value); val.Kind() {
 	case reflect.Bool:
-		return starlark.Bool(val.Bool())
+		return starlark.Bool(val.Bool()), nil
 	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
-		return starlark.MakeInt(int(val.Int()))
-	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
-		return starlark.MakeUint(uint(val.Uint()))
+		return starlark.MakeInt64(val.Int()), nil
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		return starlark.MakeUint64(val.Uint()), nil
 	case reflect.Float32, reflect.Float64:
-		return starlark.Float(val.Float())
+		return starlark.Float(val.Float()), nil
 	case reflect.String:
-		return starlark.String(val.String())
+		return starlark.String(val.String()), nil
 	case reflect.Slice:
 		if val.Type().Elem().Kind() == reflect.Uint8 {
-			return starlark.Bytes(val.Bytes())
+			return starlark.Bytes(val.Bytes()), nil
 		}
 		fallthrough
-	case reflect.Chan, reflect.Map, reflect.Ptr, reflect.Func, reflect.Struct, reflect.Interface:
+	case reflect.Chan, reflect.Map, reflect.Ptr, reflect.Func, reflect.Interface:
 		if val.IsNil() {
-			return starlark.None
+			return starlark.None, nil
 		}
-		return NewUserValue(val.Interface(), gThread)
+		return c.newUserValue(val.Interface(), thread).starlarkValue(), nil
 	default:
-		return NewUserValue(val.Interface(), gThread)
+		return c.newUserValue(val.Interface(), thread).starlarkValue(), nil
 	}
 }
 
 var (
 	refTypeSValue = reflect.TypeOf((*starlark.Value)(nil)).Elem()
+	refTypeError  = reflect.TypeOf((*error)(nil)).Elem()
 )
 
 type unsupportedError struct {
@@ -121,21 +143,37 @@ func (s unsupportedError) Error() string {
 }
 
 type conversionError struct {
-	Value starlark.Value
-	Hint  reflect.Type
+	Value    starlark.Value
+	Hint     reflect.Type
+	Func     string // function and parameter the value is passed to, if any
+	Param    string
+	Overflow bool  // the value is out of the range of Hint
+	Err      error // why the value could not be parsed as Hint, if any
 }
 
 func (c conversionError) Error() string {
+	if c.Func != "" {
+		prefix := fmt.Sprintf("%s: for parameter %s: ", c.Func, c.Param)
+		c.Func = ""
+		return prefix + c.Error()
+	}
 	if c.Value == starlark.None {
 		return fmt.Sprintf("cannot use nil as type %s", c.Hint)
 	}
 	var val interface{}
-	if userData, ok := c.Value.(*UserValue); ok {
-		val = userData.value
+	if userData, ok := asUserValue(c.Value); ok {
+		val = userData.goValue()
 	} else {
 		val = c.Value
 	}
-	return fmt.Sprintf("cannot use %v (type %T) as type %s", val, val, c.Hint)
+	msg := fmt.Sprintf("cannot use %v (type %T) as type %s", val, val, c.Hint)
+	if c.Overflow {
+		msg += ": value out of range"
+	}
+	if c.Err != nil {
+		msg += ": " + c.Err.Error()
+	}
+	return msg
 }
 
 type structFieldError struct {
@@ -147,18 +185,57 @@ func (s structFieldError) Error() string {
 	return `type ` + s.Type.String() + ` has no field ` + s.Field
 }
 
-func sValueToReflect(thread *starlark.Thread, value starlark.Value, typeHint reflect.Type) (reflect.Value, error) {
+// convertible is like reflect.Type.ConvertibleTo, but rejects conversions
+// changing the meaning of a value: int to string yields a rune in go, float
+// to int truncates.
+func convertible(from, hint reflect.Type) bool {
+	switch from.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		if hint.Kind() == reflect.String {
+			return false
+		}
+	case reflect.Float32, reflect.Float64:
+		switch hint.Kind() {
+		case reflect.String, reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+			reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+			return false
+		}
+	}
+	return from.ConvertibleTo(hint)
+}
+
+func (c *Converter) sValueToReflect(thread *starlark.Thread, value starlark.Value, typeHint reflect.Type) (reflect.Value, error) {
 	visited := make(map[interface{}]reflect.Value)
-	return sValueToReflectInner(thread, value, typeHint, visited)
+	return c.sValueToReflectInner(thread, value, typeHint, visited)
 }
 
-func sValueToReflectInner(thread *starlark.Thread, v starlark.Value, hint reflect.Type, visited map[interface{}]reflect.Value) (reflect.Value, error) {
+func (c *Converter) sValueToReflectInner(thread *starlark.Thread, v starlark.Value, hint reflect.Type, visited map[interface{}]reflect.Value) (reflect.Value, error) {
 	if hint.Implements(refTypeSValue) {
 		return reflect.ValueOf(v), nil
 	}
+	if fn, ok := c.unmarshalers[hint]; ok {
+		return fn(v, hint)
+	}
+	if val, ok, err := c.unmarshalTo(v, hint); ok || err != nil {
+		return val, err
+	}
+	if hint.Kind() == reflect.Interface && hint.NumMethod() == 0 {
+		x, err := c.toAny(v, map[starlark.Value]bool{})
+		if err != nil {
+			return reflect.Value{}, err
+		}
+		if x == nil {
+			return reflect.Zero(hint), nil
+		}
+		return reflect.ValueOf(x).Convert(hint), nil
+	}
 
 	isPtr := false
 
+	if u, ok := asUserValue(v); ok {
+		v = u
+	}
 	switch converted := v.(type) {
 	case *UserValue:
 		val := converted.rvalue
@@ -166,8 +243,15 @@ func sValueToReflectInner(thread *starlark.Thread, v starlark.Value, hint reflec
 			newVal := reflect.New(hint.Elem())
 			newVal.Elem().Set(val)
 			val = newVal
+		} else if val.Kind() == reflect.Ptr && !val.IsNil() && val.Type().Elem() == hint {
+			// like a slice or struct field, reached through a pointer
+			val = val.Elem()
 		} else {
-			if !val.Type().ConvertibleTo(hint) {
+			if !convertible(val.Type(), hint) {
+				if hint.Kind() == reflect.Func && val.Kind() == reflect.Func {
+					// a go func of another signature is called like a script function
+					return c.makeFunc(thread, converted, hint), nil
+				}
 				return reflect.Value{}, conversionError{Value: converted, Hint: hint}
 			}
 			val = val.Convert(hint)
@@ -181,36 +265,36 @@ func sValueToReflectInner(thread *starlark.Thread, v starlark.Value, hint reflec
 		return reflect.Value{}, conversionError{Value: v, Hint: hint}
 	case starlark.Bool:
 		val := reflect.ValueOf(bool(converted))
-		if !val.Type().ConvertibleTo(hint) {
+		if !convertible(val.Type(), hint) {
 			return reflect.Value{}, conversionError{Value: v, Hint: hint}
 		}
 		return val.Convert(hint), nil
 	case starlark.Bytes:
 		val := reflect.ValueOf([]byte(converted))
-		if !val.Type().ConvertibleTo(hint) {
+		if !convertible(val.Type(), hint) {
 			return reflect.Value{}, conversionError{Value: v, Hint: hint}
 		}
 		return val.Convert(hint), nil
 	case starlark.Int:
-		if i, ok := converted.Int64(); !ok {
+		return intToReflect(converted, hint)
+	case startime.Time:
+		val := reflect.ValueOf(time.Time(converted))
+		if !convertible(val.Type(), hint) {
 			return reflect.Value{}, conversionError{Value: v, Hint: hint}
-		} else {
-			val := reflect.ValueOf(int(i))
-			if !val.Type().ConvertibleTo(hint) {
-				return reflect.Value{}, conversionError{Value: v, Hint: hint}
-			}
-			return val.Convert(hint), nil
 		}
-	case starlark.Float:
-		val := reflect.ValueOf(float64(converted))
-		if !val.Type().ConvertibleTo(hint) {
+		return val.Convert(hint), nil
+	case startime.Duration:
+		val := reflect.ValueOf(time.Duration(converted))
+		if !convertible(val.Type(), hint) {
 			return reflect.Value{}, conversionError{Value: v, Hint: hint}
 		}
 		return val.Convert(hint), nil
+	case starlark.Float:
+		return floatToReflect(converted, hint)
 
 	case starlark.String:
 		val := reflect.ValueOf(string(converted))
-		if !val.Type().ConvertibleTo(hint) {
+		if !convertible(val.Type(), hint) {
 			return reflect.Value{}, conversionError{Value: v, Hint: hint}
 		}
 		return val.Convert(hint), nil
@@ -219,11 +303,11 @@ func sValueToReflectInner(thread *starlark.Thread, v starlark.Value, hint reflec
 			return reflect.Value{}, conversionError{Value: v, Hint: hint}
 		}
 		elmType := hint.Elem()
-		val := reflect.MakeSlice(elmType, converted.Len(), converted.Len())
+		val := reflect.MakeSlice(hint, converted.Len(), converted.Len())
 		for i := 0; i < converted.Len(); i++ {
-			vi, err := sValueToReflect(thread, converted.Index(i), elmType)
+			vi, err := c.sValueToReflect(thread, converted.Index(i), elmType)
 			if err != nil {
-				panic(err)
+				return reflect.Value{}, err
 			}
 			val.Index(i).Set(vi)
 		}
@@ -236,11 +320,11 @@ func sValueToReflectInner(thread *starlark.Thread, v starlark.Value, hint reflec
 			}
 		}
 		elmType := hint.Elem()
-		val := reflect.MakeSlice(elmType, converted.Len(), converted.Len())
+		val := reflect.MakeSlice(hint, converted.Len(), converted.Len())
 		for i := 0; i < converted.Len(); i++ {
-			vi, err := sValueToReflect(thread, converted.Index(i), elmType)
+			vi, err := c.sValueToReflect(thread, converted.Index(i), elmType)
 			if err != nil {
-				panic(err)
+				return reflect.Value{}, err
 			}
 			val.Index(i).Set(vi)
 		}
@@ -250,17 +334,31 @@ func sValueToReflectInner(thread *starlark.Thread, v starlark.Value, hint reflec
 			return reflect.Value{}, conversionError{Value: v, Hint: hint}
 		}
 		elmType := hint.Elem()
-		val := reflect.MakeSlice(elmType, converted.Len(), converted.Len())
+		val := reflect.MakeSlice(hint, converted.Len(), converted.Len())
 		iter := converted.Iterate()
 		var elem starlark.Value
 		for i := 0; iter.Next(&elem); i++ {
-			vi, err := sValueToReflect(thread, elem, elmType)
+			vi, err := c.sValueToReflect(thread, elem, elmType)
 			if err != nil {
-				panic(err)
+				return reflect.Value{}, err
 			}
 			val.Index(i).Set(vi)
 		}
 		return val, nil
+	case *starlarkstruct.Struct:
+		// a record is built into a go struct or map like a dict of its fields
+		fields := starlark.NewDict(len(converted.AttrNames()))
+		for _, name := range converted.AttrNames() {
+			field, err := converted.Attr(name)
+			if err != nil {
+				return reflect.Value{}, err
+			}
+			_ = fields.SetKey(starlark.String(name), field)
+		}
+		if hint.Kind() != reflect.Map && !(hint.Kind() == reflect.Struct || hint.Kind() == reflect.Ptr && hint.Elem().Kind() == reflect.Struct) {
+			return reflect.Value{}, conversionError{Value: v, Hint: hint}
+		}
+		return c.sValueToReflectInner(thread, fields, hint, visited)
 	case *starlark.Dict:
 		if existing := visited[converted]; existing.IsValid() {
 			return existing, nil
@@ -276,11 +374,11 @@ func sValueToReflectInner(thread *starlark.Thread, v starlark.Value, hint reflec
 			items := converted.Items()
 			for _, elem := range items {
 				key, value := elem[0], elem[1]
-				lKey, err := sValueToReflectInner(thread, key, keyType, visited)
+				lKey, err := c.sValueToReflectInner(thread, key, keyType, visited)
 				if err != nil {
 					return reflect.Value{}, err
 				}
-				lValue, err := sValueToReflectInner(thread, value, elemType, visited)
+				lValue, err := c.sValueToReflectInner(thread, value, elemType, visited)
 				if err != nil {
 					return reflect.Value{}, err
 				}
@@ -304,11 +402,11 @@ func sValueToReflectInner(thread *starlark.Thread, v starlark.Value, hint reflec
 				} else {
 					fieldName = val.GoString()
 				}
-				fieldVal := t.FieldByName(fieldName)
-				if !fieldVal.IsValid() {
+				fieldVal, ok := c.fieldByName(t, fieldName, true)
+				if !ok {
 					return reflect.Value{}, structFieldError{Field: fieldName, Type: hint}
 				}
-				lValue, err := sValueToReflectInner(thread, value, fieldVal.Type(), visited)
+				lValue, err := c.sValueToReflectInner(thread, value, fieldVal.Type(), visited)
 				if err != nil {
 					return reflect.Value{}, err
 				}
@@ -321,87 +419,12 @@ func sValueToReflectInner(thread *starlark.Thread, v starlark.Value, hint reflec
 		}
 
 		return reflect.Value{}, conversionError{Value: v, Hint: hint}
-	case *starlark.Function:
+	case starlark.Callable:
 		if hint.Kind() != reflect.Func {
 			return reflect.Value{}, conversionError{Value: v, Hint: hint}
 		}
-		if converted == nil {
-			return reflect.Zero(hint), nil
-		}
-		fn := func(args []reflect.Value) (ret []reflect.Value) {
-			if converted == nil {
-
-			}
-			var tArgs []starlark.Value
-			for index := range args {
-				tArgs = append(tArgs, ToValue(args[index].Interface()))
-			}
-			value, err := converted.CallInternal(thread, tArgs, nil)
-			if err != nil {
-				panic(err)
-			}
-			if value == starlark.None && hint.NumOut() != 0 {
-				panic(conversionError{Value: converted, Hint: hint})
-			}
-			if tuple, ok := value.(starlark.Tuple); ok {
-				for index := range tuple {
-					ret0, err := sValueToReflect(thread, tuple[index], hint.Out(index))
-					if err != nil {
-						panic(err)
-					}
-					ret = append(ret, ret0)
-				}
-			} else {
-				ret0, err := sValueToReflect(thread, value, hint.Out(0))
-				if err != nil {
-					panic(err)
-				}
-				ret = append(ret, ret0)
-			}
-			return
-		}
-		return reflect.MakeFunc(hint, fn), nil
-	case *starlark.Builtin:
-		if hint.Kind() != reflect.Func {
-			return reflect.Value{}, conversionError{Value: v, Hint: hint}
-		}
-		if converted == nil {
-			return reflect.Zero(hint), nil
-		}
-		fn := func(args []reflect.Value) (ret []reflect.Value) {
-			if converted == nil {
-
-			}
-			var tArgs []starlark.Value
-			for index := range args {
-				tArgs = append(tArgs, ToValue(args[index].Interface()))
-			}
-			value, err := converted.CallInternal(thread, tArgs, nil)
-			if err != nil {
-				panic(err)
-			}
-			if value == starlark.None && hint.NumOut() != 0 {
-				panic(conversionError{Value: converted, Hint: hint})
-			}
-			if tuple, ok := value.(starlark.Tuple); ok {
-				for index := range tuple {
-					ret0, err := sValueToReflect(thread, tuple[index], hint.Out(index))
-					if err != nil {
-						panic(err)
-					}
-					ret = append(ret, ret0)
-				}
-			} else {
-				ret0, err := sValueToReflect(thread, value, hint.Out(0))
-				if err != nil {
-					panic(err)
-				}
-				ret = append(ret, ret0)
-			}
-			return
-		}
-		return reflect.MakeFunc(hint, fn), nil
+		return c.makeFunc(thread, converted, hint), nil
 	}
 
-	panic("never reaches")
+	return reflect.Value{}, conversionError{Value: v, Hint: hint}
 }
@@ -0,0 +1,222 @@
+package thirdlib
+
+import (
+	"fmt"
+	"os"
+	"reflect"
+	"sync"
+	"sync/atomic"
+	"unsafe"
+
+	"go.starlark.net/starlark"
+)
+
+// cancelReason returns the reason thread was cancelled for, if it was. It
+// reads the unexported field set by Thread.Cancel, which starlark does not
+// expose, and is also set when the thread exceeds its execution steps.
+func cancelReason(thread *starlark.Thread) (string, bool) {
+	if thread == nil {
+		return "", false
+	}
+	field := reflect.ValueOf(thread).Elem().FieldByName("cancelReason")
+	if !field.IsValid() {
+		return "", false
+	}
+	reason := atomic.LoadPointer((*unsafe.Pointer)(unsafe.Pointer(field.UnsafeAddr())))
+	if reason == nil {
+		return "", false
+	}
+	return *(*string)(reason), true
+}
+
+// threadState tracks the go calls a thread is blocked in. While it is, the
+// thread is lent to one callback at a time through token.
+type threadState struct {
+	calls int
+	token chan struct{}
+}
+
+// goCall is a go call of a script. Callbacks converted for its arguments
+// report their errors to it while it runs, see callbackCaller.report.
+type goCall struct {
+	active bool
+	err    error
+}
+
+// goCallLocal holds the *goCall whose arguments a thread is converting.
+const goCallLocal = "thirdlib.goCall"
+
+var (
+	threadStatesMu sync.Mutex // guards threadStates and goCall fields
+	threadStates   = map[*starlark.Thread]*threadState{}
+)
+
+// convertingFor makes callbacks created on thread until restore is called
+// belong to call, it is set while converting the arguments of call.
+func convertingFor(thread *starlark.Thread, call *goCall) (restore func()) {
+	if thread == nil {
+		return func() {}
+	}
+	prev := thread.Local(goCallLocal)
+	thread.SetLocal(goCallLocal, call)
+	return func() { thread.SetLocal(goCallLocal, prev) }
+}
+
+// enterGoCall marks thread as blocked in call until leave is called, so
+// callbacks could run on it. leave waits for a callback still running on
+// thread, as the script continues on it, and returns the error reported by
+// a callback of call meanwhile.
+func enterGoCall(thread *starlark.Thread, call *goCall) (leave func() error) {
+	threadStatesMu.Lock()
+	call.active = true
+	if thread == nil {
+		threadStatesMu.Unlock()
+		return call.leave
+	}
+	st := threadStates[thread]
+	if st == nil {
+		st = &threadState{token: make(chan struct{}, 1)}
+		threadStates[thread] = st
+	}
+	st.calls++
+	threadStatesMu.Unlock()
+
+	var lent bool
+	select {
+	case st.token <- struct{}{}:
+		lent = true
+	default:
+		// already lent by an outer go call
+	}
+	return func() error {
+		if lent {
+			<-st.token
+		}
+		threadStatesMu.Lock()
+		if st.calls--; st.calls == 0 {
+			delete(threadStates, thread)
+		}
+		threadStatesMu.Unlock()
+		return call.leave()
+	}
+}
+
+// leave ends call, returning the error reported to it.
+func (call *goCall) leave() error {
+	threadStatesMu.Lock()
+	defer threadStatesMu.Unlock()
+	call.active = false
+	err := call.err
+	call.err = nil
+	return err
+}
+
+// reportCallbackError records err on call if it is still running, which
+// returns it to the script, it reports whether it did. Only the first error
+// is kept.
+func reportCallbackError(call *goCall, err error) bool {
+	threadStatesMu.Lock()
+	defer threadStatesMu.Unlock()
+	if call == nil || !call.active || call.err != nil {
+		return false
+	}
+	call.err = err
+	return true
+}
+
+// borrowThread takes thread for a callback if it is blocked in a go call and
+// not used by another callback.
+func borrowThread(thread *starlark.Thread) (giveBack func(), ok bool) {
+	threadStatesMu.Lock()
+	st := threadStates[thread]
+	threadStatesMu.Unlock()
+	if st == nil {
+		return nil, false
+	}
+	select {
+	case <-st.token:
+		return func() { st.token <- struct{}{} }, true
+	default:
+		return nil, false
+	}
+}
+
+// callbackCaller calls starlark callbacks for go code. A callback runs on
+// the thread it was created on while that thread is blocked in a go call,
+// like a sort.Slice less function. Called from another goroutine at the same
+// time, or after the call returned, it runs on a child thread inheriting the
+// thread locals, load and print handlers of the thread.
+type callbackCaller struct {
+	thread *starlark.Thread
+	locals map[string]interface{} // of thread when the callback was created
+	origin *goCall                // the callback was passed to, if any
+}
+
+func newCallbackCaller(thread *starlark.Thread) *callbackCaller {
+	cc := &callbackCaller{thread: thread, locals: threadLocals(thread)}
+	if origin, ok := cc.locals[goCallLocal].(*goCall); ok {
+		cc.origin = origin
+	}
+	delete(cc.locals, goCallLocal)
+	return cc
+}
+
+func (cc *callbackCaller) call(fn starlark.Callable, args starlark.Tuple) (starlark.Value, error) {
+	if cc.thread == nil {
+		return starlark.Call(&starlark.Thread{Name: "callback"}, fn, args, nil)
+	}
+	if reason, cancelled := cancelReason(cc.thread); cancelled {
+		return nil, fmt.Errorf("%s: thread %s was cancelled: %s", fn.Name(), cc.thread.Name, reason)
+	}
+	if giveBack, ok := borrowThread(cc.thread); ok {
+		defer giveBack()
+		return starlark.Call(cc.thread, fn, args, nil)
+	}
+	child := &starlark.Thread{
+		Name:  cc.thread.Name,
+		Print: cc.thread.Print,
+		Load:  cc.thread.Load,
+	}
+	for key, value := range cc.locals {
+		child.SetLocal(key, value)
+	}
+	return starlark.Call(child, fn, args, nil)
+}
+
+// report reports err of a callback whose go func type has no error result,
+// panicking could crash the program, as go code may call it on any
+// goroutine. err fails the go call the callback was passed to while that
+// call runs, otherwise, like for a callback stored by a call that returned,
+// or a later error of the call, it is printed with the print handler of the
+// thread.
+func (cc *callbackCaller) report(err error) {
+	if reportCallbackError(cc.origin, err) {
+		return
+	}
+	msg := "callback error: " + err.Error()
+	if cc.thread != nil && cc.thread.Print != nil {
+		cc.thread.Print(cc.thread, msg)
+		return
+	}
+	fmt.Fprintln(os.Stderr, msg)
+}
+
+// threadLocals returns a copy of the values set by Thread.SetLocal, which
+// starlark does not expose. It must be called on the goroutine running
+// thread.
+func threadLocals(thread *starlark.Thread) map[string]interface{} {
+	if thread == nil {
+		return nil
+	}
+	field := reflect.ValueOf(thread).Elem().FieldByName("locals")
+	if !field.IsValid() || field.Kind() != reflect.Map {
+		return nil
+	}
+	field = reflect.NewAt(field.Type(), unsafe.Pointer(field.UnsafeAddr())).Elem()
+	locals := make(map[string]interface{}, field.Len())
+	iter := field.MapRange()
+	for iter.Next() {
+		locals[iter.Key().String()] = iter.Value().Interface()
+	}
+	return locals
+}
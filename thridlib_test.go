@@ -1,29 +1,1390 @@
 package thirdlib
 
 import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"math"
+	"math/big"
+	"net"
+	"net/http"
+	"net/url"
+	"reflect"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
 
+	startime "go.starlark.net/lib/time"
 	"go.starlark.net/starlark"
+	"go.starlark.net/starlarkstruct"
 )
 
+// evalTest is a starlark expression and the value, or error, it evaluates to.
+type evalTest struct{ src, want string }
+
+// runEvalTests evaluates the tests on thread, reporting those whose result,
+// or error message, does not match want.
+func runEvalTests(t *testing.T, thread *starlark.Thread, predeclared starlark.StringDict, tests []evalTest, match func(got, want string) bool) {
+	t.Helper()
+	for _, test := range tests {
+		var got string
+		if v, err := starlark.Eval(thread, "<expr>", test.src, predeclared); err != nil {
+			got = err.Error()
+		} else {
+			got = v.String()
+		}
+		if !match(got, test.want) {
+			t.Errorf("eval %s = %s, want %s", test.src, got, test.want)
+		}
+	}
+}
+
+func exactly(got, want string) bool { return got == want }
+
 func TestEvalGreetLib(t *testing.T) {
 	thread := new(starlark.Thread)
 	InstallAllExampleModule(starlark.Universe)
-	for _, test := range []struct{ src, want string }{
+	runEvalTests(t, thread, nil, []evalTest{
 		{`greet.new().Hello()`, `"hello: <>"`},
 		{`greet.newWithName("tom").Hello()`, `"hello: <tom>"`},
 		{`greet.new().RenameWithFunc(lambda a: "tom").Hello()`, `"hello: <tom>"`},
 		{`greet.new().RenameWithFunc(lambda a: a+"tom").Hello()`, `"hello: <tom>"`},
 		{`resty.new().SetCookie({"Name": "a", "Value": "b"})`, ``},
+	}, exactly)
+}
+
+func TestEvalKwargs(t *testing.T) {
+	thread := new(starlark.Thread)
+	InstallAllExampleModule(starlark.Universe)
+	runEvalTests(t, thread, nil, []evalTest{
+		{`greet.newWithName(name="tom").Hello()`, `"hello: <tom>"`},
+		{`greet.newWithName(nick="tom")`, `greet.newWithName: unexpected keyword argument nick`},
+		{`greet.newWithName("tom", name="tom")`, `greet.newWithName: got multiple values for keyword argument name`},
+		{`len(resty.new().SetCookie(Name="a", Value="b").Cookies)`, `1`},
+		{`resty.new().SetCookie(Nick="a")`, `*resty.Client.SetCookie: for parameter 1: type http.Cookie has no field Nick`},
+	}, exactly)
+}
+
+func TestEvalVariadic(t *testing.T) {
+	thread := new(starlark.Thread)
+	InstallAllExampleModule(starlark.Universe)
+	runEvalTests(t, thread, nil, []evalTest{
+		{`fmt.sprintf("%s-%d", "a", 1)`, `"a-1"`},
+		{`fmt.sprintf("%s")`, `"%!s(MISSING)"`},
+		{`fmt.sprintf(*["%s-%s", "a", "b"])`, `"a-b"`},
+		{`fmt.sprintf("%s-%s", a=["a", "b"])`, `"a-b"`},
+		{`fmt.sprintf("%s", "a", a=["b"])`, `fmt.sprintf: got multiple values for keyword argument a`},
+		{`fmt.sprintf()`, `fmt.sprintf: missing argument for format`},
+		{`exec.run("echo", "hi")[0]`, `b"hi\n"`},
+	}, exactly)
+}
+
+func TestEvalArity(t *testing.T) {
+	thread := new(starlark.Thread)
+	InstallAllExampleModule(starlark.Universe)
+	runEvalTests(t, thread, nil, []evalTest{
+		{`greet.newWithName()`, `greet.newWithName: missing argument for name`},
+		{`greet.new(1)`, `greet.new: got 1 arguments, want 0`},
+		{`greet.new().HelloTo()`, `*thirdlib.Greet.HelloTo: got 0 arguments, want 1`},
+		{`greet.new().HelloTo(1)`, `*thirdlib.Greet.HelloTo: for parameter 1: cannot use 1 (type starlark.Int) as type string`},
+		{`greet.newWithName(name=1)`, `greet.newWithName: for parameter name: cannot use 1 (type starlark.Int) as type string`},
+		{`strings.split("a,b", ",", ",")`, `strings.split: got 3 arguments, want 2`},
+	}, exactly)
+}
+
+func TestEvalRecoverPanic(t *testing.T) {
+	thread := new(starlark.Thread)
+	InstallAllExampleModule(starlark.Universe)
+	runEvalTests(t, thread, nil, []evalTest{
+		{`exec.run()`, `exec.run: go panic: runtime error: slice bounds out of range [1:0]`},
+		{`greet.new().RenameWithFunc(lambda a: fail("x"))`, `fail: x`},
+		{`greet.new().RenameWithFunc(lambda a: 1)`, `cannot use 1 (type starlark.Int) as type string`},
+		{`greet.default()`, `type *thirdlib.Greet does not support Call`},
+		{`len(greet.default)`, `len: value of type *thirdlib.Greet has no len`},
+		{`[x for x in greet.default]`, `*thirdlib.Greet value is not iterable`},
+	}, exactly)
+
+	DebugStack = true
+	defer func() { DebugStack = false }()
+	_, err := starlark.Eval(thread, "<expr>", `exec.run()`, nil)
+	if err == nil || !strings.Contains(err.Error(), "runtime/debug.Stack") {
+		t.Errorf("eval exec.run() = %v, want go stack trace", err)
+	}
+}
+
+func TestEvalRaiseErrors(t *testing.T) {
+	thread := new(starlark.Thread)
+	InstallAllExampleModule(starlark.Universe)
+	predeclared := starlark.StringDict{
+		"url": NewModule("url", starlark.StringDict{
+			"parse": ToValue(url.Parse),
+		}, RaiseErrors()),
+		"regexp": NewModule("regexp", starlark.StringDict{
+			"match_string": ToValue(regexp.MatchString),
+		}, RaiseErrors()),
+	}
+	runEvalTests(t, thread, predeclared, []evalTest{
+		{`url.parse("http://a.com/b").Path`, `"/b"`},
+		{`url.parse(":")`, `url.parse: parse ":": missing protocol scheme`},
+		{`url.parse("http://a.com/b").Parse(":")`, `*url.URL.Parse: parse ":": missing protocol scheme`},
+		{`regexp.match_string("a+", "aa")`, `True`},
+		{`go.try_call(url.parse, ":")[1]`, `parse ":": missing protocol scheme`},
+		{`go.try_call(url.parse, "http://a.com")[1]`, `None`},
+		{`go.try_call(greet.new().HelloTo, 1)`, `(None, "*thirdlib.Greet.HelloTo: for parameter 1: cannot use 1 (type starlark.Int) as type string")`},
+		{`go.try_call(greet.new().HelloTo, "a")`, `("hello: <a>", None)`},
+	}, exactly)
+
+	// the example modules are not declared with RaiseErrors
+	if v, err := starlark.Eval(thread, "<expr>", `url.parse(":")[1]`, nil); err != nil || v == starlark.None {
+		t.Errorf("url.parse(\":\")[1] = %v, %v, want the error", v, err)
+	}
+}
+
+func TestThreadBinding(t *testing.T) {
+	InstallAllExampleModule(starlark.Universe)
+	thread := &starlark.Thread{Name: "bound"}
+	v, err := starlark.Eval(thread, "<expr>", `greet.new()`, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := v.(*UserValue).thread; got != thread {
+		t.Errorf("greet.new() bound to %v, want %v", got, thread)
+	}
+	if got := ToValueWithThread(&Greet{}, thread).(*UserValue).thread; got != thread {
+		t.Errorf("ToValueWithThread bound to %v, want %v", got, thread)
+	}
+
+	// callbacks passed to a go function run on the calling thread
+	var printed string
+	thread.Print = func(_ *starlark.Thread, msg string) { printed = msg }
+	v, err = starlark.Eval(thread, "<expr>", `greet.new().RenameWithFunc(lambda a: print("x") or "tom").Hello()`, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v.String() != `"hello: <tom>"` || printed != "x" {
+		t.Errorf("got %s, printed %q", v, printed)
+	}
+}
+
+func TestConverter(t *testing.T) {
+	c := NewConverter()
+	c.RegisterMarshaler(reflect.TypeOf(time.Duration(0)), func(v reflect.Value) (starlark.Value, error) {
+		return startime.Duration(v.Int()), nil
+	})
+	c.RegisterUnmarshaler(reflect.TypeOf(time.Duration(0)), func(v starlark.Value, hint reflect.Type) (reflect.Value, error) {
+		d, ok := v.(startime.Duration)
+		if !ok {
+			return reflect.Value{}, fmt.Errorf("want time.duration, got %s", v.Type())
+		}
+		return reflect.ValueOf(time.Duration(d)), nil
+	})
+	c.RegisterMarshaler(reflect.TypeOf((*big.Int)(nil)), func(v reflect.Value) (starlark.Value, error) {
+		return starlark.MakeBigInt(v.Interface().(*big.Int)), nil
+	})
+	c.RegisterUnmarshaler(reflect.TypeOf((*big.Int)(nil)), func(v starlark.Value, hint reflect.Type) (reflect.Value, error) {
+		i, ok := v.(starlark.Int)
+		if !ok {
+			return reflect.Value{}, fmt.Errorf("want int, got %s", v.Type())
+		}
+		return reflect.ValueOf(i.BigInt()), nil
+	})
+	predeclared := starlark.StringDict{
+		"time": startime.Module,
+		"conv": NewModule("conv", starlark.StringDict{
+			"double": c.ToValue(func(d time.Duration) time.Duration { return 2 * d }),
+			"square": c.ToValue(func(i *big.Int) *big.Int { return new(big.Int).Mul(i, i) }),
+		}),
+	}
+	thread := new(starlark.Thread)
+	runEvalTests(t, thread, predeclared, []evalTest{
+		{`conv.double(time.parse_duration("1s"))`, `2s`},
+		{`type(conv.double(time.second))`, `"time.duration"`},
+		{`conv.double(1)`, `conv.double: for parameter 1: want time.duration, got int`},
+		{`conv.square(100000000000000000000)`, `10000000000000000000000000000000000000000`},
+	}, exactly)
+
+	// a failing marshaler keeps values reached without a way to fail wrapped
+	c.RegisterMarshaler(reflect.TypeOf(bad{}), func(reflect.Value) (starlark.Value, error) {
+		return nil, fmt.Errorf("bad marshaler")
+	})
+	predeclared = starlark.StringDict{"s": c.ToValue([]bad{{1}})}
+	if v, err := starlark.Eval(thread, "<expr>", `(type(s[0]), s[0].N, [type(x) for x in s])`, predeclared); err != nil || v.String() != `("thirdlib.bad", 1, ["thirdlib.bad"])` {
+		t.Errorf("failing marshaler: got %v, %v", v, err)
+	}
+	if _, err := c.TryToValue(bad{}, nil); err == nil || err.Error() != "bad marshaler" {
+		t.Errorf("TryToValue: got %v", err)
+	}
+}
+
+type bad struct{ N int }
+
+func TestZeroConverter(t *testing.T) {
+	c := &Converter{}
+	c.RegisterMarshaler(reflect.TypeOf(time.Duration(0)), func(v reflect.Value) (starlark.Value, error) {
+		return startime.Duration(v.Int()), nil
+	})
+	c.RegisterUnmarshaler(reflect.TypeOf(time.Duration(0)), func(v starlark.Value, hint reflect.Type) (reflect.Value, error) {
+		return reflect.ValueOf(time.Duration(v.(startime.Duration))), nil
+	})
+	predeclared := starlark.StringDict{
+		"double": c.ToValue(func(d time.Duration) time.Duration { return 2 * d }),
+		"second": c.ToValue(time.Second),
+	}
+	if v, err := starlark.Eval(new(starlark.Thread), "<expr>", `double(second)`, predeclared); err != nil || v.String() != "2s" {
+		t.Errorf("zero converter: got %v, %v", v, err)
+	}
+}
+
+type tagged struct {
+	StatusCode int
+	Name       string `starlark:"nick"`
+	Secret     string `starlark:"-"`
+	ID         string `json:"identifier,omitempty"`
+}
+
+func TestStructTags(t *testing.T) {
+	c := NewConverter()
+	c.JSONTags, c.SnakeCaseFields = true, true
+	predeclared := starlark.StringDict{
+		"tags": NewModule("tags", starlark.StringDict{
+			"new":  c.ToValue(func() *tagged { return &tagged{StatusCode: 200, Name: "tom", Secret: "x", ID: "1"} }),
+			"nick": c.ToValue(func(t tagged) string { return t.Name + t.ID }),
+		}),
+	}
+	thread := new(starlark.Thread)
+	runEvalTests(t, thread, predeclared, []evalTest{
+		{`tags.new().status_code`, `200`},
+		{`tags.new().StatusCode`, `200`},
+		{`tags.new().nick`, `"tom"`},
+		{`tags.new().identifier`, `"1"`},
+		{`tags.new().Secret`, `type *thirdlib.tagged does not support Attr: Secret`},
+		{`dir(tags.new())`, `["identifier", "nick", "status_code"]`},
+		{`tags.nick({"nick": "bob", "identifier": "2"})`, `"bob2"`},
+		{`tags.nick({"secret": "x"})`, `tags.nick: for parameter 1: type thirdlib.tagged has no field secret`},
+	}, exactly)
+
+	globals, err := starlark.ExecFile(thread, "<file>", "t = tags.new()\nt.nick = 'bob'\nname = t.Name", predeclared)
+	if err != nil || globals["name"] != starlark.String("bob") {
+		t.Errorf("set field by tag name = %v, %v", globals["name"], err)
+	}
+
+	for name, want := range map[string]string{
+		"StatusCode": "status_code", "HTTPServer": "http_server", "ID": "id", "Base64Data": "base64_data",
+	} {
+		if got := snakeCase(name); got != want {
+			t.Errorf("snakeCase(%s) = %s, want %s", name, got, want)
+		}
+	}
+}
+
+type collided struct {
+	Greeting string `starlark:"hello"`
+}
+
+func (c collided) Hello() string   { return "method" }
+func (c collided) HTTPGet() string { return "HTTPGet" }
+func (c collided) HttpGet() string { return "HttpGet" }
+
+func TestSnakeCaseMethods(t *testing.T) {
+	c := NewConverter()
+	c.SnakeCaseMethods = true
+	predeclared := starlark.StringDict{
+		"greet":    NewModule("greet", starlark.StringDict{"new": c.ToValue(NewGreet)}),
+		"collided": c.ToValue(&collided{Greeting: "field"}),
+	}
+	thread := new(starlark.Thread)
+	runEvalTests(t, thread, predeclared, []evalTest{
+		{`greet.new().rename_with_func(lambda a: "tom").hello()`, `"hello: <tom>"`},
+		{`greet.new().RenameWithFunc(lambda a: "tom").Hello()`, `"hello: <tom>"`},
+		{`greet.new().hello_to()`, `*thirdlib.Greet.hello_to: got 0 arguments, want 1`},
+		{`dir(greet.new())`, `["CopyFrom", "Hello", "HelloTo", "Name", "RenameWithFunc", "copy_from", "hello", "hello_to", "rename_with_func"]`},
+		{`collided.hello`, `"field"`},
+		{`collided.Hello()`, `"method"`},
+		{`collided.http_get()`, `"HTTPGet"`},
+		{`dir(collided)`, `["HTTPGet", "Hello", "HttpGet", "hello", "http_get"]`},
+	}, exactly)
+}
+
+type base struct {
+	ID   int
+	Kind string
+}
+
+func (b *base) Describe() string { return fmt.Sprintf("%s#%d", b.Kind, b.ID) }
+
+type Meta struct {
+	Kind  string
+	Owner string
+}
+
+type derived struct {
+	base
+	*Meta
+	Name   string
+	hidden string
+}
+
+func (d derived) Title() string { return d.Name }
+
+func TestAttrNames(t *testing.T) {
+	predeclared := starlark.StringDict{
+		"derived": ToValue(&derived{base: base{ID: 1, Kind: "base"}, Name: "d"}),
+		"value":   ToValue(func() derived { return derived{base: base{ID: 2, Kind: "v"}} }),
+		"m":       ToValue(M{}),
+	}
+	thread := new(starlark.Thread)
+	runEvalTests(t, thread, predeclared, []evalTest{
+		{`dir(derived)`, `["Describe", "ID", "Meta", "Name", "Owner", "Title"]`},
+		{`derived.ID`, `1`},
+		{`derived.Describe()`, `"base#1"`},
+		{`derived.Owner`, `None`},
+		{`derived.Kind`, `type *thirdlib.derived does not support Attr: Kind`},
+		{`derived.hidden`, `type *thirdlib.derived does not support Attr: hidden`},
+		{`dir(value())`, `["Describe", "ID", "Meta", "Name", "Owner", "Title"]`},
+		{`value().Describe()`, `"v#2"`},
+		{`dir(m)`, `["clear", "get", "items", "keys", "pop", "setdefault", "update", "values"]`},
+	}, exactly)
+
+	globals, err := starlark.ExecFile(thread, "<file>", "derived.Owner = 'tom'\nowner = derived.Meta.Owner", predeclared)
+	if err != nil || globals["owner"] != starlark.String("tom") {
+		t.Errorf("set promoted field = %v, %v", globals["owner"], err)
+	}
+}
+
+func TestFreeze(t *testing.T) {
+	InstallAllExampleModule(starlark.Universe)
+	d := ToValue(&derived{Meta: &Meta{}})
+	m := ToValue(M{"a": 1})
+	d.Freeze()
+	m.Freeze()
+	predeclared := starlark.StringDict{"d": d, "m": m}
+	thread := new(starlark.Thread)
+	for _, test := range []struct{ src, want string }{
+		{"greet.default.Name = 'x'", "cannot set field of frozen *thirdlib.Greet"},
+		{"g = greet.new()\ng.Name = 'x'", ""},
+		{"d.Name = 'x'", "cannot set field of frozen *thirdlib.derived"},
+		{"d.Meta.Owner = 'x'", "cannot set field of frozen *thirdlib.Meta"},
+		{"m['b'] = 1", "cannot insert into frozen map[string]interface {}"},
 	} {
 		var got string
-		if v, err := starlark.Eval(thread, "<expr>", test.src, nil); err != nil {
-			got = err.Error()
-		} else {
-			got = v.String()
+		if _, err := starlark.ExecFile(thread, "<file>", test.src, predeclared); err != nil {
+			got = err.(*starlark.EvalError).Msg
 		}
 		if got != test.want {
-			t.Errorf("eval %s = %s, want %s", test.src, got, test.want)
+			t.Errorf("exec %s = %s, want %s", test.src, got, test.want)
+		}
+	}
+
+	c := NewConverter()
+	c.CopyOnFreeze = true
+	goMap := M{"a": 1}
+	copied := c.ToValue(goMap)
+	copied.Freeze()
+	goMap["a"] = 2
+	if v, _, _ := copied.(*UserValue).Get(starlark.String("a")); v != starlark.MakeInt(1) {
+		t.Errorf("frozen copy sees %v, want 1", v)
+	}
+}
+
+type point struct{ X, Y int }
+
+type level int
+
+type byteSize uint64
+
+func TestCompare(t *testing.T) {
+	InstallAllExampleModule(starlark.Universe)
+	predeclared := starlark.StringDict{
+		"point": ToValue(func(x, y int) point { return point{x, y} }),
+		"low":   NewUserValue(level(1), nil),
+		"high":  NewUserValue(level(2), nil),
+	}
+	thread := new(starlark.Thread)
+	runEvalTests(t, thread, predeclared, []evalTest{
+		{`bool(greet.new())`, `True`},
+		{`bool(point(0, 0))`, `False`},
+		{`bool(point(0, 1))`, `True`},
+		{`bool(go.new_e())`, `False`},
+		{`bool(go.new_m())`, `False`},
+		{`point(1, 2) == point(1, 2)`, `True`},
+		{`point(1, 2) != point(2, 1)`, `True`},
+		{`greet.new() == greet.new()`, `False`},
+		{`(lambda g: g == g)(greet.new())`, `True`},
+		{`{point(1, 2): "a"}[point(1, 2)]`, `"a"`},
+		{`{go.new_m(): 1}`, `unhashable type: map[string]interface {}`},
+		{`low < high`, `True`},
+		{`sorted([high, low])`, `[1, 2]`},
+		{`point(1, 2) < point(2, 1)`, `thirdlib.point < thirdlib.point not implemented`},
+	}, exactly)
+}
+
+func TestOperators(t *testing.T) {
+	c := NewConverter()
+	c.KeepNamedNumbers = true
+	predeclared := starlark.StringDict{
+		"second": c.ToValue(time.Second),
+		"big": c.ToValue(func(s string) *big.Int {
+			i, _ := new(big.Int).SetString(s, 10)
+			return i
+		}),
+		"low":   c.ToValue(level(1)),
+		"max":   c.ToValue(time.Duration(math.MaxInt64)),
+		"min":   c.ToValue(time.Duration(math.MinInt64)),
+		"size":  c.ToValue(byteSize(math.MaxUint64)),
+		"cents": c.ToValue(func(n int64) money { return money{n} }),
+		"vec":   c.ToValue(func(x, y int) *vec { return &vec{x, y} }),
+	}
+	thread := new(starlark.Thread)
+	runEvalTests(t, thread, predeclared, []evalTest{
+		{`second * 3`, `3s`},
+		{`2 * second`, `2s`},
+		{`second - second * 2`, `-1s`},
+		{`-second`, `-1s`},
+		{`second // 3`, `333.333333ms`},
+		{`second < second * 2`, `True`},
+		{`second.Seconds()`, `1.0`},
+		{`second + "a"`, `unknown binary op: time.Duration + string`},
+		{`second // 0`, `integer division by zero`},
+		{`low * 2 + 1`, `3`},
+		{`type(low - 1)`, `"thirdlib.level"`},
+		{`big("10") + big("5")`, `15`},
+		{`big("10") - big("3")`, `7`},
+		{`big("123456789012345678901234567890") * big("10")`, `1234567890123456789012345678900`},
+		{`-big("3")`, `-3`},
+		{`big("1") < big("2")`, `True`},
+		{`sorted([big("3"), big("1"), big("2")])`, `[1, 2, 3]`},
+		{`max + second`, `time.Duration overflow`},
+		{`min - second`, `time.Duration overflow`},
+		{`max * 2`, `time.Duration overflow`},
+		{`min * -1`, `time.Duration overflow`},
+		{`-min`, `time.Duration overflow`},
+		{`min // -1`, `time.Duration overflow`},
+		{`min % -1`, `0s`},
+		{`-max`, `-2562047h47m16.854775807s`},
+		{`size + 1`, `thirdlib.byteSize overflow`},
+		{`size * 2`, `thirdlib.byteSize overflow`},
+		{`size - size`, `0`},
+		// methods in the x.Add(y) style
+		{`cents(150) + cents(25)`, `175c`},
+		{`-cents(5)`, `-5c`},
+		{`cents(1) < cents(2)`, `True`},
+		{`sorted([cents(3), cents(1), cents(2)])`, `[1c, 2c, 3c]`},
+		{`cents(1) - cents(2)`, `unknown binary op: thirdlib.money - thirdlib.money`},
+		// and in the z.Add(x, y) style
+		{`vec(1, 2) + vec(3, 4)`, `(4, 6)`},
+		{`-vec(1, 2)`, `(-1, -2)`},
+		{`type(vec(1, 2) + vec(3, 4))`, `"*thirdlib.vec"`},
+	}, exactly)
+}
+
+// money has operator methods in the x.Add(y) style.
+type money struct{ cents int64 }
+
+func (m money) Add(o money) money { return money{m.cents + o.cents} }
+func (m money) Neg() money        { return money{-m.cents} }
+func (m money) Cmp(o money) int   { return int(m.cents - o.cents) }
+func (m money) String() string    { return fmt.Sprintf("%dc", m.cents) }
+
+// vec has operator methods in the math/big z.Add(x, y) style.
+type vec struct{ X, Y int }
+
+func (z *vec) Add(x, y *vec) *vec {
+	z.X, z.Y = x.X+y.X, x.Y+y.Y
+	return z
+}
+
+func (z *vec) Neg(x *vec) *vec {
+	z.X, z.Y = -x.X, -x.Y
+	return z
+}
+
+func (z *vec) String() string { return fmt.Sprintf("(%d, %d)", z.X, z.Y) }
+
+func TestIterate(t *testing.T) {
+	ch := make(chan int, 3)
+	ch <- 1
+	ch <- 2
+	close(ch)
+	ready := make(chan int, 2)
+	ready <- 5
+	close(ready)
+	arr := [2]string{"a", "b"}
+	predeclared := starlark.StringDict{
+		"ch":      ToValue(ch),
+		"bind":    Bind,
+		"unbound": ToValue(make(chan int)),
+		"arr":     ToValue(&arr),
+		"ptr":     ToValue(&[]int{3, 4}),
+		"m":       ToValue(&map[string]int{"k": 1}),
+		"seq": ToValue(func(yield func(int) bool) {
+			for i := 0; i < 5; i++ {
+				if !yield(i) {
+					return
+				}
+			}
+		}),
+		"pairs": ToValue(func(yield func(string, int) bool) {
+			yield("x", 1)
+		}),
+	}
+	thread := new(starlark.Thread)
+	predeclared["blocked"] = NewUserValue(make(chan int), thread)
+	predeclared["ready"] = ToValue(ready)
+	runEvalTests(t, thread, predeclared, []evalTest{
+		{`list(bind(ch))`, `[1, 2]`},
+		{`list(bind(ready))`, `[5]`},
+		{`list(unbound)`, `list: for parameter 1: got chan int (unbound, see go.bind), want iterable`},
+		{`[x for x in unbound]`, `chan int (unbound, see go.bind) value is not iterable`},
+		{`str(unbound) == str(bind(unbound)), bool(unbound)`, `(True, True)`},
+		{`list(arr)`, `["a", "b"]`},
+		{`[x * 2 for x in ptr]`, `[6, 8]`},
+		{`len(ptr)`, `2`},
+		{`list(m)`, `["k"]`},
+		{`list(seq)`, `[0, 1, 2, 3, 4]`},
+		{`[x for x in seq if x < 2]`, `[0, 1]`},
+		{`list(pairs)`, `[("x", 1)]`},
+	}, exactly)
+
+	if _, ok := predeclared["unbound"].(*UnboundChan); !ok {
+		t.Errorf("ToValue(chan int) = %T, want *UnboundChan", predeclared["unbound"])
+	}
+	if v, ok := GoValue(predeclared["unbound"]); !ok || reflect.TypeOf(v) != reflect.TypeOf(make(chan int)) {
+		t.Errorf("GoValue(unbound) = %T, %v", v, ok)
+	}
+
+	// a loop waiting on a channel ends when the thread is cancelled
+	go func() {
+		time.Sleep(20 * time.Millisecond)
+		thread.Cancel("timeout")
+	}()
+	if _, err := starlark.ExecFile(thread, "<file>", "def f():\n  for x in blocked:\n    pass\nf()\n", predeclared); err == nil || !strings.Contains(err.Error(), "timeout") {
+		t.Errorf("iterate blocked channel: got %v, want cancellation", err)
+	}
+
+	// a channel created by ToValue iterates once bound to the running thread
+	thread = new(starlark.Thread)
+	go func() {
+		time.Sleep(20 * time.Millisecond)
+		thread.Cancel("timeout")
+	}()
+	if _, err := starlark.ExecFile(thread, "<file>", "def f():\n  for x in bind(unbound):\n    pass\nf()\n", predeclared); err == nil || !strings.Contains(err.Error(), "timeout") {
+		t.Errorf("iterate bound channel: got %v, want cancellation", err)
+	}
+}
+
+func TestSlice(t *testing.T) {
+	arr := [5]int{0, 1, 2, 3, 4}
+	predeclared := starlark.StringDict{
+		"s":     ToValue([]int{0, 1, 2, 3, 4}),
+		"arr":   ToValue(&arr),
+		"str":   NewUserValue("hello", nil),
+		"names": ToValue([]string{"a", "b"}),
+		"sptr":  ToValue(new(string)),
+	}
+	thread := new(starlark.Thread)
+	runEvalTests(t, thread, predeclared, []evalTest{
+		{`s[1:3]`, `[1, 2]`},
+		{`s[::2]`, `[0, 2, 4]`},
+		{`s[::-1]`, `[4, 3, 2, 1, 0]`},
+		{`s[3:0:-2]`, `[3, 1]`},
+		{`s[-2:100]`, `[3, 4]`},
+		{`s[4:1]`, `[]`},
+		{`arr[1:4:2]`, `[1, 3]`},
+		{`str[1:3]`, `"el"`},
+		{`str[::-1]`, `"olleh"`},
+		{`str[1]`, `"e"`},
+		{`s[-1]`, `4`},
+		{`s[5]`, `[]int index 5 out of range [-5:4]`},
+		{`"b" in names`, `True`},
+		{`"c" in names`, `False`},
+		{`1 in names`, `False`},
+		{`"a" not in names`, `False`},
+		{`4 in arr`, `True`},
+		{`5 in s`, `False`},
+		{`names[-1]`, `"b"`},
+		{`names["a"]`, `[]string index: got string, want int`},
+		{`"" in sptr`, `False`},
+		{`len(sptr)`, `len: value of type *string has no len`},
+	}, exactly)
+
+	// host code unwraps sequences returned by scripts
+	v, err := starlark.Eval(thread, "<expr>", `names`, predeclared)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s, ok := v.(*Sequence); !ok || s.UserValue().Len() != 2 {
+		t.Errorf("ToValue([]string) = %T, want *Sequence", v)
+	}
+	if got, ok := GoValue(v); !ok || !reflect.DeepEqual(got, []string{"a", "b"}) {
+		t.Errorf("GoValue = %v, %v", got, ok)
+	}
+
+	c := NewConverter()
+	c.SliceViews = true
+	predeclared = starlark.StringDict{"arr": c.ToValue(&arr)}
+	if _, err := starlark.ExecFile(thread, "<file>", "v = arr[1:3]\nv[0] = 10\nr = arr[::-2]\nr[0] = 20\n", predeclared); err != nil {
+		t.Fatal(err)
+	}
+	if arr != [5]int{0, 10, 2, 3, 4} {
+		t.Errorf("slice view: got %v, want [0 10 2 3 4]", arr)
+	}
+}
+
+func TestMapping(t *testing.T) {
+	c := NewConverter()
+	c.SortedMapKeys = true
+	m := map[string]int{"b": 2, "a": 1, "c": 3}
+	var nilMap map[string]int
+	predeclared := starlark.StringDict{
+		"m":      c.ToValue(m),
+		"ptr":    c.ToValue(&map[int]string{2: "two", 1: "one"}),
+		"nilmap": NewUserValue(nilMap, nil),
+	}
+	thread := new(starlark.Thread)
+	runEvalTests(t, thread, predeclared, []evalTest{
+		{`list(m)`, `["a", "b", "c"]`},
+		{`m.keys()`, `["a", "b", "c"]`},
+		{`m.values()`, `[1, 2, 3]`},
+		{`m.items()`, `[("a", 1), ("b", 2), ("c", 3)]`},
+		{`ptr.items()`, `[(1, "one"), (2, "two")]`},
+		{`ptr[2]`, `"two"`},
+		{`m.get("a"), m.get("z"), m.get("z", 0)`, `(1, None, 0)`},
+		{`"a" in m, "z" in m, 1 in m`, `(True, False, False)`},
+		{`m["z"]`, `key "z" not in map[string]int`},
+		{`m.pop("z")`, `pop: missing key "z"`},
+		{`m.pop("z", -1)`, `-1`},
+		{`m.update([("a", "x")])`, `update: cannot use "x" (type starlark.String) as type int`},
+		{`m.update(1)`, `update: got int, want iterable`},
+		{`len(nilmap), nilmap.get("a")`, `(0, None)`},
+	}, exactly)
+
+	src := `
+m.pop("b")
+m.update({"d": 4}, e=5)
+m.update([("f", 6)])
+m.setdefault("a", 10)
+m.setdefault("g", 7)
+m["h"] = 8
+`
+	if _, err := starlark.ExecFile(thread, "<file>", src, predeclared); err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]int{"a": 1, "c": 3, "d": 4, "e": 5, "f": 6, "g": 7, "h": 8}
+	if !reflect.DeepEqual(m, want) {
+		t.Errorf("update: got %v, want %v", m, want)
+	}
+	if _, err := starlark.ExecFile(thread, "<file>", `nilmap["a"] = 1`, predeclared); err == nil || !strings.Contains(err.Error(), "nil map") {
+		t.Errorf("insert into nil map: got %v", err)
+	}
+	frozen := c.ToValue(map[string]int{"a": 1})
+	frozen.Freeze()
+	if _, err := starlark.Eval(thread, "<expr>", `m.pop("a")`, starlark.StringDict{"m": frozen}); err == nil || err.Error() != "pop: cannot delete from frozen map[string]int" {
+		t.Errorf("pop frozen: got %v", err)
+	}
+
+	// functions put into a module-level value run on the calling thread
+	fs := map[string]func(){}
+	var printed []string
+	printer := &starlark.Thread{Print: func(_ *starlark.Thread, msg string) { printed = append(printed, msg) }}
+	src = `
+fs.update(a=lambda: print("update"))
+fs.setdefault("b", lambda: print("setdefault"))
+`
+	if _, err := starlark.ExecFile(printer, "<file>", src, starlark.StringDict{"fs": ToValue(fs)}); err != nil {
+		t.Fatal(err)
+	}
+	for _, key := range []string{"a", "b"} {
+		fs[key]()
+	}
+	if want := []string{"update", "setdefault"}; !reflect.DeepEqual(printed, want) {
+		t.Errorf("callbacks of inserted functions: got %v, want %v", printed, want)
+	}
+}
+
+func TestSliceMethods(t *testing.T) {
+	ints := []int{1, 2}
+	predeclared := starlark.StringDict{
+		"s":   ToValue(&ints),
+		"val": ToValue([]string{"a"}),
+	}
+	thread := new(starlark.Thread)
+	src := `
+s.append(3)
+s.extend([4, 5])
+s.insert(0, 0)
+s.insert(-1, 9)
+s.insert(100, 6)
+popped = [s.pop(), s.pop(0), s.pop(-2)]
+val.append("b")
+after = (list(val), len(val))
+`
+	globals, err := starlark.ExecFile(thread, "<file>", src, predeclared)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []int{1, 2, 3, 4, 5}; !reflect.DeepEqual(ints, want) {
+		t.Errorf("slice methods: got %v, want %v", ints, want)
+	}
+	if got := globals["popped"].String(); got != "[6, 0, 9]" {
+		t.Errorf("pop: got %s", got)
+	}
+	if got := globals["after"].String(); got != `(["a", "b"], 2)` {
+		t.Errorf("append to slice value: got %s", got)
+	}
+
+	runEvalTests(t, thread, predeclared, []evalTest{
+		{`s.append("x")`, `append: cannot use "x" (type starlark.String) as type int`},
+		{`s.extend([7, "x"])`, `extend: cannot use "x" (type starlark.String) as type int`},
+		{`s.pop(10)`, `pop: index 10 out of range [-5:4]`},
+		{`s.clear()`, `None`},
+		{`s.pop()`, `pop: index -1 out of range [0:-1]`},
+	}, exactly)
+	if len(ints) != 0 {
+		t.Errorf("clear: got %v", ints)
+	}
+
+	frozen := ToValue([]int{1})
+	frozen.Freeze()
+	if _, err := starlark.Eval(thread, "<expr>", `s.append(2)`, starlark.StringDict{"s": frozen}); err == nil || err.Error() != "append: cannot append to frozen []int" {
+		t.Errorf("append frozen: got %v", err)
+	}
+
+	// slice fields are reached through a pointer, so list methods change them
+	h := &holder{Items: []int{1}}
+	src = `
+h.Items.append(2)
+h.Tags.append("a")
+fields = (len(h.Items), 2 in h.Items, bool(h.Tags), h.Tags[0])
+`
+	globals, err = starlark.ExecFile(thread, "<file>", src, starlark.StringDict{"h": ToValue(h)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := (holder{Items: []int{1, 2}, Tags: []string{"a"}}); !reflect.DeepEqual(*h, want) {
+		t.Errorf("slice fields: got %+v, want %+v", *h, want)
+	}
+	if got := globals["fields"].String(); got != `(2, True, True, "a")` {
+		t.Errorf("slice fields: got %s", got)
+	}
+	if v, err := starlark.Eval(thread, "<expr>", `(len(h.Tags), bool(h.Tags))`, starlark.StringDict{"h": ToValue(&holder{})}); err != nil || v.String() != "(0, False)" {
+		t.Errorf("nil slice field: got %v, %v", v, err)
+	}
+
+	// the fields are still passed by value
+	predeclared = starlark.StringDict{
+		"h": ToValue(&holder{Items: []int{1, 2}, At: point{X: 3}}),
+		"sum": ToValue(func(xs []int) int {
+			total := 0
+			for _, x := range xs {
+				total += x
+			}
+			return total
+		}),
+		"x": ToValue(func(p point) int { return p.X }),
+	}
+	if v, err := starlark.Eval(thread, "<expr>", `(sum(h.Items), x(h.At))`, predeclared); err != nil || v.String() != "(3, 3)" {
+		t.Errorf("pass fields by value: got %v, %v", v, err)
+	}
+
+	// functions added to a module-level value run on the calling thread
+	var fs []func()
+	var printed []string
+	printer := &starlark.Thread{Print: func(_ *starlark.Thread, msg string) { printed = append(printed, msg) }}
+	src = `
+fs.append(lambda: print("append"))
+fs.extend([lambda: print("extend")])
+fs.insert(0, lambda: print("insert"))
+`
+	if _, err := starlark.ExecFile(printer, "<file>", src, starlark.StringDict{"fs": ToValue(&fs)}); err != nil {
+		t.Fatal(err)
+	}
+	for _, f := range fs {
+		f()
+	}
+	if want := []string{"insert", "append", "extend"}; !reflect.DeepEqual(printed, want) {
+		t.Errorf("callbacks of appended functions: got %v, want %v", printed, want)
+	}
+}
+
+type holder struct {
+	Items []int
+	Tags  []string
+	At    point
+}
+
+type node struct {
+	Name     string
+	Weight   float32
+	Tags     map[string]int
+	Children []*node
+	Created  time.Time
+	Timeout  time.Duration
+	hidden   int
+}
+
+func TestDeepConversion(t *testing.T) {
+	created := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	tree := &node{
+		Name:     "root",
+		Weight:   1.5,
+		Tags:     map[string]int{"a": 1},
+		Children: []*node{{Name: "leaf"}},
+		Created:  created,
+		Timeout:  time.Second,
+	}
+	v, err := ToStarlark(tree)
+	if err != nil {
+		t.Fatal(err)
+	}
+	thread := new(starlark.Thread)
+	runEvalTests(t, thread, starlark.StringDict{"v": v}, []evalTest{
+		{`v.Name, v.Weight, v.Tags`, `("root", 1.5, {"a": 1})`},
+		{`v.Children[0].Name, v.Children[0].Tags, v.Children[0].Children`, `("leaf", None, None)`},
+		{`v.Created.year, v.Timeout`, `(2020, 1s)`},
+		{`type(v), type(v.Children)`, `("struct", "list")`},
+		{`hasattr(v, "hidden")`, `False`},
+	}, exactly)
+
+	cyclic := &node{Name: "cyclic"}
+	cyclic.Children = []*node{cyclic}
+	if _, err := ToStarlark(cyclic); err == nil || err.Error() != "ToStarlark: cycle through *thirdlib.node" {
+		t.Errorf("cycle: got %v", err)
+	}
+	c := NewConverter()
+	c.MaxDepth = 2
+	if _, err := c.ToStarlark([][][]int{{{1}}}); err == nil || err.Error() != "ToStarlark: int exceeds max depth 2" {
+		t.Errorf("max depth: got %v", err)
+	}
+	if _, err := ToStarlark(func() {}); err == nil || err.Error() != "ToStarlark: cannot convert func()" {
+		t.Errorf("func: got %v", err)
+	}
+	if v := DecodeValue(func() {}); v != starlark.None {
+		t.Errorf("decode func: got %v, want None", v)
+	}
+	// a value reached twice without a cycle is fine
+	shared := &node{Name: "shared"}
+	if _, err := ToStarlark([]*node{shared, shared}); err != nil {
+		t.Errorf("shared: got %v", err)
+	}
+
+	var back struct {
+		Name    string
+		Tags    map[string]int
+		Created time.Time
+		Timeout time.Duration
+	}
+	src, err := starlark.Eval(thread, "<expr>", `{"Name": v.Name, "Tags": v.Tags, "Created": v.Created, "Timeout": v.Timeout}`, starlark.StringDict{"v": v})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := FromStarlark(src, &back); err != nil {
+		t.Fatal(err)
+	}
+	if back.Name != "root" || back.Tags["a"] != 1 || !back.Created.Equal(created) || back.Timeout != time.Second {
+		t.Errorf("FromStarlark: got %+v", back)
+	}
+	var ints []int
+	if err := FromStarlark(starlark.NewList([]starlark.Value{starlark.MakeInt(1), starlark.String("x")}), &ints); err == nil {
+		t.Errorf("FromStarlark: got %v, want error", ints)
+	}
+	if err := FromStarlark(starlark.None, ints); err == nil || err.Error() != "FromStarlark: got []int, want non-nil pointer" {
+		t.Errorf("FromStarlark non-pointer: got %v", err)
+	}
+}
+
+func TestStructRecords(t *testing.T) {
+	InstallAllExampleModule(starlark.Universe)
+	thread := new(starlark.Thread)
+	c := NewConverter()
+	c.StructRecords = true
+	c.SnakeCaseFields = true
+	c.RegisterMarshaler(reflect.TypeOf(broken{}), func(reflect.Value) (starlark.Value, error) {
+		return nil, fmt.Errorf("broken")
+	})
+	j := &job{Name: "a", Run: func() string { return "ran" }}
+	j.Next = j
+	predeclared := starlark.StringDict{
+		"record": c.ToValue(&node{Name: "root", Children: []*node{{Name: "leaf"}}}),
+		"job":    c.ToValue(j),
+		"request": c.ToValue(func() (*http.Request, error) {
+			return http.NewRequest("GET", "http://a.com/x", nil)
+		}),
+		"broken": c.ToValue(func() broken { return broken{} }),
+		"hello":  ToValue(func(g *Greet) string { return g.Hello() }),
+		"names":  ToValue(func(m map[string]string) string { return m["Name"] }),
+		"struct": starlark.NewBuiltin("struct", starlarkstruct.Make),
+	}
+	runEvalTests(t, thread, predeclared, []evalTest{
+		{`go.to_struct(greet.newWithName("tom"))`, `struct(Name = "tom")`},
+		{`go.to_struct(go.to_struct(greet.new()))`, `struct(Name = "")`},
+		{`go.to_struct(1)`, `to_struct: got int, want go struct`},
+		{`go.to_struct(go.new_m())`, `to_struct: ToStruct: got map[string]interface {}, want struct`},
+		{`type(record), record.name, record.children[0].name`, `("struct", "root", "leaf")`},
+		{`hello(go.to_struct(greet.newWithName("tom")))`, `"hello: <tom>"`},
+		{`hello(struct(Name = "ann"))`, `"hello: <ann>"`},
+		{`names(struct(Name = "ann"))`, `"ann"`},
+		{`hello(struct(Nick = "ann"))`, `for parameter 1: type thirdlib.Greet has no field Nick`},
+		// funcs, channels and cycles stay wrapped
+		{`job.run(), job.done, job.next.name, type(job.next)`, `("ran", None, "a", "*thirdlib.job")`},
+		{`request()[0].method, request()[0].url.path`, `("GET", "/x")`},
+		{`type(go.to_struct(resty.new())), type(go.to_struct(resty.new()).JSONMarshal)`, `("struct", "func(interface {}) ([]uint8, error)")`},
+	}, strings.HasSuffix)
+
+	// a failing marshaler fails the call instead of panicking
+	if _, err := starlark.Eval(thread, "<expr>", `broken()`, predeclared); err == nil || !strings.HasSuffix(err.Error(), ": broken") || strings.Contains(err.Error(), "go panic") {
+		t.Errorf("broken marshaler: got %v", err)
+	}
+}
+
+type job struct {
+	Name string
+	Run  func() string
+	Done chan int
+	Next *job
+}
+
+type broken struct{}
+
+func TestIntegerConversion(t *testing.T) {
+	thread := new(starlark.Thread)
+	predeclared := starlark.StringDict{
+		"int8":    ToValue(func(i int8) int8 { return i }),
+		"uint32":  ToValue(func(u uint32) uint32 { return u }),
+		"uint64":  ToValue(func(u uint64) uint64 { return u }),
+		"float32": ToValue(func(f float32) float32 { return f }),
+		"big":     ToValue(func(i *big.Int) *big.Int { return new(big.Int).Mul(i, big.NewInt(2)) }),
+		"bigf":    ToValue(func(f *big.Float) *big.Float { return f }),
+		"any":     ToValue(func(v interface{}) string { return fmt.Sprintf("%T", v) }),
+		"maxu64":  ToValue(uint64(math.MaxUint64)),
+	}
+	runEvalTests(t, thread, predeclared, []evalTest{
+		{`int8(127)`, `127`},
+		{`int8(128)`, `for parameter 1: cannot use 128 (type starlark.Int) as type int8: value out of range`},
+		{`int8(-129)`, `for parameter 1: cannot use -129 (type starlark.Int) as type int8: value out of range`},
+		{`uint32(4294967295)`, `4294967295`},
+		{`uint32(-1)`, `for parameter 1: cannot use -1 (type starlark.Int) as type uint32: value out of range`},
+		{`uint64(18446744073709551615)`, `18446744073709551615`},
+		{`uint64(18446744073709551616)`, `value out of range`},
+		{`maxu64`, `18446744073709551615`},
+		{`float32(1e39)`, `for parameter 1: cannot use 1e+39 (type starlark.Float) as type float32: value out of range`},
+		{`float32(1.5)`, `1.5`},
+		{`big(123456789012345678901234567890)`, `246913578024691357802469135780`},
+		{`bigf(1)`, `1.0`},
+		{`bigf(2.5)`, `2.5`},
+		{`any(1), any(123456789012345678901234567890)`, `("int64", "*big.Int")`},
+	}, strings.HasSuffix)
+	if v, err := ToStarlark(big.NewInt(7)); err != nil || v.String() != "7" {
+		t.Errorf("ToStarlark(big.Int) = %v, %v", v, err)
+	}
+}
+
+func TestAnyConversion(t *testing.T) {
+	InstallAllExampleModule(starlark.Universe)
+	thread := new(starlark.Thread)
+	set1 := new(starlark.Set)
+	_ = set1.Insert(starlark.MakeInt(1))
+	predeclared := starlark.StringDict{
+		"show": ToValue(func(v interface{}) string { return fmt.Sprintf("%T %v", v, v) }),
+		"json": ToValue(func(v interface{}) (string, error) {
+			b, err := json.Marshal(v)
+			return string(b), err
+		}),
+		"struct": starlark.NewBuiltin("struct", starlarkstruct.Make),
+		"set1":   set1,
+	}
+	runEvalTests(t, thread, predeclared, []evalTest{
+		{`show(None)`, `"<nil> <nil>"`},
+		{`show(1.5)`, `"float64 1.5"`},
+		{`show([1, "a"])`, `"[]interface {} [1 a]"`},
+		{`show((1, 2))`, `"[]interface {} [1 2]"`},
+		{`show(set1)`, `"[]interface {} [1]"`},
+		{`show({"a": [1]})`, `"map[string]interface {} map[a:[1]]"`},
+		{`show(struct(a = 1))`, `"map[string]interface {} map[a:1]"`},
+		{`show(greet.newWithName("tom"))`, `"*thirdlib.Greet &{tom}"`},
+		{`show({1: 2})`, `for parameter 1: cannot use dict with int key as type map[string]interface {}`},
+		{`json({"a": [1, 2.5, True, None], "b": struct(c = "d")})[0]`, `"{\"a\":[1,2.5,true,null],\"b\":{\"c\":\"d\"}}"`},
+		{`go.to_star_type({"a": [1]})`, `{"a": [1]}`},
+		{`show(len)`, `"*starlark.Builtin <built-in function len>"`},
+	}, strings.HasSuffix)
+	if _, err := starlark.ExecFile(thread, "<file>", "l = []\nl.append(l)\nshow(l)\n", predeclared); err == nil || !strings.Contains(err.Error(), "cannot convert list containing itself") {
+		t.Errorf("cyclic list: got %v", err)
+	}
+}
+
+func TestCallbacks(t *testing.T) {
+	InstallAllExampleModule(starlark.Universe)
+	thread := new(starlark.Thread)
+	predeclared := starlark.StringDict{
+		"apply": ToValue(func(f func(string) (string, error), s string) string {
+			r, err := f(s)
+			if err != nil {
+				return "error: " + err.Error()
+			}
+			return r
+		}),
+		"run":   ToValue(func(f func()) { f() }),
+		"pair":  ToValue(func(f func() (int, string)) string { i, s := f(); return fmt.Sprint(i, " ", s) }),
+		"sum":   ToValue(func(f func(...int) int) int { return f(1, 2, 3) }),
+		"upper": ToValue(func(s string, n int) string { return strings.Repeat(strings.ToUpper(s), n) }),
+	}
+	runEvalTests(t, thread, predeclared, []evalTest{
+		{`greet.new().RenameWithFunc(greet.newWithName("tom").HelloTo).Hello()`, `"hello: <hello: <>>"`},
+		{`greet.new().RenameWithFunc(str).Hello()`, `"hello: <>"`},
+		{`greet.new().RenameWithFunc("x{}y".format).Hello()`, `"hello: <xy>"`},
+		{`apply(lambda s: s + "!", "a")`, `"a!"`},
+		{`apply(lambda s: fail("boom"), "a")`, `"error: fail: boom"`},
+		{`apply(lambda s: 1, "a")`, `"error: cannot use 1 (type starlark.Int) as type string"`},
+		{`apply(lambda s, t: s, "a")`, `"error: function lambda missing 1 argument (t)"`},
+		{`apply(lambda s: upper(s, 2), "a")`, `"AA"`},
+		{`run(lambda: None)`, `None`},
+		{`run(lambda: 1)`, `lambda: got int result, want None`},
+		{`pair(lambda: (1, "a"))`, `"1 a"`},
+		{`pair(lambda: (1, "a", 2))`, `lambda: got 3 results, want 2`},
+		{`pair(lambda: 1)`, `lambda: got int result, want tuple of 2`},
+		{`sum(lambda *a: a[0] + a[1] + a[2])`, `6`},
+		{`greet.new().RenameWithFunc(upper)`, `got 1 arguments, want 2`},
+		{`apply(1, "a")`, `for parameter 1: cannot use 1 (type starlark.Int) as type func(string) (string, error)`},
+	}, strings.HasSuffix)
+}
+
+func TestConcurrentCallbacks(t *testing.T) {
+	var stored func(int) int
+	predeclared := starlark.StringDict{
+		"parallel": ToValue(func(f func(int) int) int {
+			var wg sync.WaitGroup
+			results := make([]int, 8)
+			for i := range results {
+				wg.Add(1)
+				go func(i int) {
+					defer wg.Done()
+					results[i] = f(i)
+				}(i)
+			}
+			wg.Wait()
+			sum := 0
+			for _, r := range results {
+				sum += r
+			}
+			return sum
+		}),
+		"sort": ToValue(func(xs []int, less func(a, b int) bool) []int {
+			sort.Slice(xs, func(i, j int) bool { return less(xs[i], xs[j]) })
+			return xs
+		}),
+		"store": ToValue(func(f func(int) int) { stored = f }),
+		"local": starlark.NewBuiltin("local", func(thread *starlark.Thread, b *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+			return starlark.MakeInt(thread.Local("offset").(int)), nil
+		}),
+	}
+	var printed int32
+	var reported atomic.Value
+	thread := &starlark.Thread{Name: "main", Print: func(_ *starlark.Thread, msg string) {
+		if strings.HasPrefix(msg, "callback error: ") {
+			reported.Store(msg)
+			return
+		}
+		atomic.AddInt32(&printed, 1)
+	}}
+	thread.SetLocal("offset", 10)
+	src := `
+def double(x):
+    print(x)
+    return x * 2 + local()
+total = parallel(double)
+ordered = list(sort([3, 1, 2], lambda a, b: a > b))
+store(double)
+`
+	globals, err := starlark.ExecFile(thread, "<file>", src, predeclared)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := globals["total"].String(); got != "136" {
+		t.Errorf("parallel: got %s, want 136", got)
+	}
+	if got := globals["ordered"].String(); got != "[3, 2, 1]" {
+		t.Errorf("sort: got %s", got)
+	}
+	if printed != 8 {
+		t.Errorf("printed %d times, want 8", printed)
+	}
+
+	// after the script finished, on a child thread
+	if got := stored(5); got != 20 {
+		t.Errorf("stored callback: got %d, want 20", got)
+	}
+	// failing callbacks fail the go call, even called from goroutines
+	runEvalTests(t, thread, predeclared, []evalTest{
+		{`parallel(lambda x: fail("bad") if x == 3 else x)`, `fail: bad`},
+		{`sort([2, 1], lambda a, b: fail("less"))`, `fail: less`},
+		{`parallel(lambda x: "x")`, `cannot use "x" (type starlark.String) as type int`},
+		{`parallel(lambda x: x)`, `28`},
+	}, exactly)
+
+	// a stored callback does not fail a later go call, nor does a second
+	// error of a call, they are printed
+	var later func(int)
+	predeclared["keep"] = ToValue(func(f func(int)) { later = f })
+	predeclared["run"] = ToValue(func(x int) { later(x) })
+	predeclared["each"] = ToValue(func(f func(int)) {
+		f(1)
+		f(2)
+	})
+	for _, test := range []struct{ src, want, printed string }{
+		{`keep(lambda x: fail("stored")), run(1)`, `(None, None)`, `callback error: fail: stored`},
+		{`each(lambda x: fail("each %d" % x))`, `fail: each 1`, `callback error: fail: each 2`},
+	} {
+		reported.Store("")
+		runEvalTests(t, thread, predeclared, []evalTest{{test.src, test.want}}, exactly)
+		if msg := reported.Load().(string); msg != test.printed {
+			t.Errorf("eval %s printed %q, want %q", test.src, msg, test.printed)
+		}
+	}
+
+	// without a go call to fail, the error is printed
+	thread.Cancel("done")
+	if got := stored(1); got != 0 {
+		t.Errorf("cancelled callback: got %d, want 0", got)
+	}
+	if msg, _ := reported.Load().(string); !strings.Contains(msg, "thread main was cancelled: done") {
+		t.Errorf("cancelled callback: printed %q", msg)
+	}
+}
+
+// TestThreadFields fails when starlark renames the unexported Thread fields
+// read by cancelReason and threadLocals, which would then silently report no
+// cancellation and no locals.
+func TestThreadFields(t *testing.T) {
+	threadType := reflect.TypeOf(starlark.Thread{})
+	for name, want := range map[string]reflect.Type{
+		"cancelReason": reflect.TypeOf((*string)(nil)),
+		"locals":       reflect.TypeOf(map[string]interface{}{}),
+	} {
+		if f, ok := threadType.FieldByName(name); !ok || f.Type != want {
+			t.Errorf("starlark.Thread.%s: got %v, want field of type %s", name, f.Type, want)
+		}
+	}
+
+	thread := new(starlark.Thread)
+	thread.SetLocal("key", "value")
+	if got := threadLocals(thread)["key"]; got != "value" {
+		t.Errorf("threadLocals: got %v", got)
+	}
+	thread.Cancel("stop")
+	if reason, ok := cancelReason(thread); !ok || reason != "stop" {
+		t.Errorf("cancelReason: got %q, %v", reason, ok)
+	}
+}
+
+type ctxKey struct{}
+
+func TestContextInjection(t *testing.T) {
+	InstallAllExampleModule(starlark.Universe)
+	var last string
+	predeclared := starlark.StringDict{
+		"sleep": ToValue(func(ctx context.Context, seconds float64) string {
+			select {
+			case <-ctx.Done():
+				last = ctx.Err().Error()
+			case <-time.After(time.Duration(seconds * float64(time.Second))):
+				last = "slept"
+			}
+			return last
+		}),
+		"value": ToValue(func(ctx context.Context) interface{} { return ctx.Value(ctxKey{}) }),
+	}
+	thread := new(starlark.Thread)
+	thread.SetLocal(ContextLocal, context.WithValue(context.Background(), ctxKey{}, "host"))
+	runEvalTests(t, thread, predeclared, []evalTest{
+		{`sleep(0)`, `"slept"`},
+		{`value()`, `"host"`},
+		{`sleep(context.background(), 0)`, `"slept"`},
+		{`sleep(context.with_timeout(0.01)[0], 10)`, `"context deadline exceeded"`},
+		{`value(context.with_timeout(1)[0])`, `"host"`},
+		{`value(context.background())`, `None`},
+	}, exactly)
+	src := `
+ctx, cancel = context.with_cancel()
+cancel()
+err = ctx.Err().Error()
+`
+	globals, err := starlark.ExecFile(thread, "<file>", src, predeclared)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := globals["err"].String(); got != `"context canceled"` {
+		t.Errorf("with_cancel: got %s", got)
+	}
+
+	// cancelling the thread reaches go code blocked in a call
+	go func() {
+		time.Sleep(20 * time.Millisecond)
+		thread.Cancel("stop")
+	}()
+	start := time.Now()
+	_, err = starlark.ExecFile(thread, "<file>", `sleep(10)`, predeclared)
+	if err == nil || err.Error() != "Starlark computation cancelled: stop" {
+		t.Errorf("cancel thread: got %v", err)
+	}
+	if last != "context canceled" || time.Since(start) > 5*time.Second {
+		t.Errorf("cancel thread: sleep got %s after %s", last, time.Since(start))
+	}
+
+	// so does cancelling it while go code waits on a context derived from
+	// the thread's, but calls without one are not watched
+	thread = new(starlark.Thread)
+	go func() {
+		time.Sleep(20 * time.Millisecond)
+		thread.Cancel("stop")
+	}()
+	last = ""
+	_, err = starlark.ExecFile(thread, "<file>", `sleep(context.with_timeout(10)[0], 10)`, predeclared)
+	if err == nil || last != "context canceled" {
+		t.Errorf("cancel derived context: got %v, sleep got %s", err, last)
+	}
+	tc := contextOf(thread)
+	for _, test := range []struct {
+		args []reflect.Value
+		want bool
+	}{
+		{nil, false},
+		{[]reflect.Value{reflect.ValueOf(1)}, false},
+		{[]reflect.Value{reflect.ValueOf(context.Background())}, false},
+		{[]reflect.Value{reflect.ValueOf(&tc).Elem()}, true},
+		{[]reflect.Value{reflect.ValueOf(1), reflect.ValueOf(context.WithValue(tc, ctxKey{}, 1))}, true},
+		{[]reflect.Value{reflect.Zero(refTypeContext)}, false},
+	} {
+		if got := usesThreadContext(thread, test.args); got != test.want {
+			t.Errorf("usesThreadContext(%v) = %v, want %v", test.args, got, test.want)
+		}
+	}
+	if usesThreadContext(new(starlark.Thread), []reflect.Value{reflect.ValueOf(tc)}) {
+		t.Errorf("usesThreadContext: context of another thread")
+	}
+
+	// releasing a bound context cancels what go calls got, not the host's
+	host, cancelHost := context.WithCancel(context.WithValue(context.Background(), ctxKey{}, "server"))
+	defer cancelHost()
+	var got context.Context
+	predeclared["keep"] = ToValue(func(ctx context.Context) { got = ctx })
+	thread = new(starlark.Thread)
+	release := BindContext(thread, host)
+	if _, err := starlark.ExecFile(thread, "<file>", `keep()`, predeclared); err != nil {
+		t.Fatal(err)
+	}
+	if got == nil || got.Value(ctxKey{}) != "server" || got.Err() != nil {
+		t.Fatalf("bound context: got %v", got)
+	}
+	release()
+	if got.Err() != context.Canceled || host.Err() != nil {
+		t.Errorf("release: got %v, host %v", got.Err(), host.Err())
+	}
+}
+
+type celsius float64
+
+func (c *celsius) UnmarshalJSON(data []byte) error {
+	var v struct{ Degrees float64 }
+	if err := json.Unmarshal(data, &v); err != nil {
+		return err
+	}
+	*c = celsius(v.Degrees)
+	return nil
+}
+
+func TestTextConversion(t *testing.T) {
+	thread := new(starlark.Thread)
+	predeclared := starlark.StringDict{
+		"ip":       ToValue(func(ip net.IP) string { return fmt.Sprint(len(ip), " ", ip) }),
+		"date":     ToValue(func(t time.Time) int { return t.Year() }),
+		"timeout":  ToValue(func(d time.Duration) string { return d.String() }),
+		"temp":     ToValue(func(c celsius) float64 { return float64(c) }),
+		"tempPtr":  ToValue(func(c *celsius) float64 { return float64(*c) }),
+		"bigint":   ToValue(func(i *big.Int) string { return i.String() }),
+		"duration": ToValue(time.Second),
+	}
+	runEvalTests(t, thread, predeclared, []evalTest{
+		{`ip("10.0.0.1")`, `"16 10.0.0.1"`},
+		{`ip("x")`, `for parameter 1: cannot use "x" (type starlark.String) as type net.IP: invalid IP address: x`},
+		{`date("2021-09-01T00:00:00Z")`, `2021`},
+		{`date("2021")`, `as type time.Time: parsing time "2021" as "2006-01-02T15:04:05Z07:00": cannot parse "" as "-"`},
+		{`timeout("5s")`, `"5s"`},
+		{`timeout(5)`, `"5ns"`},
+		{`timeout("5")`, `cannot use "5" (type starlark.String) as type time.Duration: time: missing unit in duration "5"`},
+		{`temp({"Degrees": 21.5})`, `21.5`},
+		{`tempPtr({"Degrees": 1})`, `1.0`},
+		{`temp([1])`, `json: cannot unmarshal array into Go value of type struct { Degrees float64 }`},
+		{`bigint("123456789012345678901234567890")`, `"123456789012345678901234567890"`},
+		{`duration`, `1000000000`},
+	}, strings.HasSuffix)
+
+	c := NewConverter()
+	c.TextMarshalers = true
+	for _, test := range []struct {
+		value interface{}
+		want  string
+	}{
+		{net.ParseIP("10.0.0.1"), `"10.0.0.1"`},
+		{time.Date(2021, 9, 1, 0, 0, 0, 0, time.UTC), `2021-09-01 00:00:00 +0000 UTC`},
+		{time.Second, `1s`},
+		{big.NewInt(5), `5`},
+		{[]net.IP{net.ParseIP("::1")}, `["::1"]`},
+	} {
+		v, err := c.ToStarlark(test.value)
+		if err != nil || v.String() != test.want {
+			t.Errorf("ToStarlark(%v) = %v, %v, want %s", test.value, v, err, test.want)
+		}
+	}
+	if got := c.ToValue(net.ParseIP("::1")).String(); got != `"::1"` {
+		t.Errorf("ToValue(net.IP) = %s", got)
+	}
+	// built-in mappings come first
+	if got := c.ToValue(time.Second).String(); got != `1000000000` {
+		t.Errorf("ToValue(time.Duration) = %s", got)
+	}
+	if got := c.ToValue(new(big.Int).Lsh(big.NewInt(1), 70)).String(); got != `1180591620717411303424` {
+		t.Errorf("ToValue(*big.Int) = %s", got)
+	}
+}
+
+type counter struct{ N int }
+
+func (c *counter) Inc() { c.N++ }
+
+type tally int
+
+func (t *tally) Inc() { *t++ }
+
+func TestPointerMethodsOnValues(t *testing.T) {
+	thread := new(starlark.Thread)
+	c := NewConverter()
+	c.KeepNamedNumbers = true
+	predeclared := starlark.StringDict{
+		"mk":    ToValue(func() counter { return counter{} }),
+		"tally": c.ToValue(func() tally { return 0 }),
+		"read":  ToValue(func(c counter) int { return c.N }),
+	}
+	src := `
+c = mk()
+c.Inc()
+c.Inc()
+n = c.N
+passed = read(c)
+c.N = 5
+assigned = c.N
+t = tally()
+t.Inc()
+`
+	globals, err := starlark.ExecFile(thread, "<file>", src, predeclared)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, want := range map[string]string{"n": "2", "passed": "2", "assigned": "5", "t": "1"} {
+		if got := globals[name].String(); got != want {
+			t.Errorf("%s = %s, want %s", name, got, want)
 		}
 	}
 }
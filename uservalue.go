@@ -2,9 +2,12 @@ package thirdlib
 
 import (
 	"fmt"
+	"hash/fnv"
 	"reflect"
+	"sort"
 
 	"go.starlark.net/starlark"
+	"go.starlark.net/syntax"
 )
 
 var l = map[reflect.Type]bool{}
@@ -14,63 +17,319 @@ type UserValue struct {
 	rvalue reflect.Value
 	rtype  reflect.Type
 	thread *starlark.Thread
+	params []param // declared parameters of a func, see WithParams
+	name   string  // name of a func, set by NewModule
+
+	raiseErrors bool // see RaiseErrors
+	frozen      bool
+	conv        *Converter
 }
 
 func NewUserValue(value interface{}, thread *starlark.Thread) *UserValue {
 	return &UserValue{value: value,
-		rvalue: reflect.ValueOf(value),
+		rvalue: addressable(reflect.ValueOf(value)),
 		rtype:  reflect.TypeOf(value),
 		thread: thread,
+		conv:   DefaultConverter,
+	}
+}
+
+// addressable returns an addressable copy of a struct or array, or of a
+// value with pointer receiver methods, so these methods and field
+// assignments change the wrapped value instead of a temporary copy.
+func addressable(v reflect.Value) reflect.Value {
+	if !v.IsValid() || v.CanAddr() {
+		return v
+	}
+	switch t := v.Type(); {
+	case t.Kind() == reflect.Struct || t.Kind() == reflect.Array,
+		t.Kind() != reflect.Ptr && t.Kind() != reflect.Interface && reflect.PtrTo(t).NumMethod() > t.NumMethod():
+		p := reflect.New(t)
+		p.Elem().Set(v)
+		return p.Elem()
 	}
+	return v
+}
+
+// goValue returns the go value wrapped by u, including changes made through
+// its methods and fields.
+func (u *UserValue) goValue() interface{} {
+	if !u.rvalue.IsValid() {
+		return u.value
+	}
+	return u.rvalue.Interface()
+}
+
+// toValue converts a go value derived from u, like a field or an element,
+// the result inherits the thread and options of u.
+func (u *UserValue) toValue(value interface{}) starlark.Value {
+	v := u.toValueWithThread(value, u.thread)
+	if child, ok := asUserValue(v); ok && u.frozen {
+		child.frozen = true
+	}
+	return v
+}
+
+// toValueWithThread is like toValue, binding the result to thread. Its
+// callers, like Index or iterators, could not report an error, so a value
+// whose marshaler fails is wrapped as UserValue instead.
+func (u *UserValue) toValueWithThread(value interface{}, thread *starlark.Thread) starlark.Value {
+	v, err := u.convertResult(value, thread)
+	if err != nil {
+		child := u.conv.newUserValue(value, thread)
+		child.raiseErrors = u.raiseErrors
+		return child.starlarkValue()
+	}
+	return v
+}
+
+// convertResult is like toValueWithThread, returning the error of a failing
+// marshaler.
+func (u *UserValue) convertResult(value interface{}, thread *starlark.Thread) (starlark.Value, error) {
+	v, err := u.conv.toValue(value, thread)
+	if err != nil {
+		return nil, err
+	}
+	if child, ok := asUserValue(v); ok && child != u {
+		child.raiseErrors = u.raiseErrors
+	}
+	return v, nil
 }
 
 func (u *UserValue) String() string {
-	return fmt.Sprintf("%v", u.value)
+	return fmt.Sprintf("%v", u.goValue())
 }
 
 func (u *UserValue) Type() string {
-	return reflect.TypeOf(u.value).String()
+	return u.rtype.String()
 }
 
+// Freeze makes SetField, SetKey and SetIndex of u and values reached through
+// it fail, methods of the go value could still mutate it. With CopyOnFreeze
+// a map or slice is copied first, so go code holding it can not change what
+// scripts see either.
 func (u *UserValue) Freeze() {
+	if u.frozen {
+		return
+	}
+	if u.conv.CopyOnFreeze {
+		switch u.rtype.Kind() {
+		case reflect.Map, reflect.Slice:
+			u.rvalue = deepCopy(u.rvalue)
+			u.value = u.rvalue.Interface()
+		}
+	}
+	u.frozen = true
+}
+
+func (u *UserValue) checkMutable(verb string) error {
+	if u.frozen {
+		return fmt.Errorf("cannot %s frozen %s", verb, u.Type())
+	}
+	return nil
+}
+
+// deepCopy copies maps and slices in v recursively, other values are shared.
+func deepCopy(v reflect.Value) reflect.Value {
+	switch v.Kind() {
+	case reflect.Map:
+		if v.IsNil() {
+			return v
+		}
+		c := reflect.MakeMapWithSize(v.Type(), v.Len())
+		iter := v.MapRange()
+		for iter.Next() {
+			c.SetMapIndex(iter.Key(), deepCopy(iter.Value()))
+		}
+		return c
+	case reflect.Slice:
+		if v.IsNil() {
+			return v
+		}
+		c := reflect.MakeSlice(v.Type(), v.Len(), v.Len())
+		for i := 0; i < v.Len(); i++ {
+			c.Index(i).Set(deepCopy(v.Index(i)))
+		}
+		return c
+	case reflect.Interface:
+		if v.IsNil() {
+			return v
+		}
+		c := reflect.New(v.Type()).Elem()
+		c.Set(deepCopy(v.Elem()))
+		return c
+	}
+	return v
 }
 
+// Truth is False for nil, empty and zero go values.
 func (u *UserValue) Truth() starlark.Bool {
-	return starlark.Bool(reflect.ValueOf(u.value).IsNil())
+	switch u.rvalue.Kind() {
+	case reflect.Ptr:
+		if !u.rvalue.IsNil() && u.rtype.Elem().Kind() == reflect.Slice {
+			// like a slice field, reached through a pointer
+			return starlark.Bool(u.rvalue.Elem().Len() > 0)
+		}
+		return !starlark.Bool(u.rvalue.IsNil())
+	case reflect.Chan, reflect.Func, reflect.Interface, reflect.UnsafePointer:
+		return !starlark.Bool(u.rvalue.IsNil())
+	case reflect.Map, reflect.Slice:
+		return starlark.Bool(!u.rvalue.IsNil() && u.rvalue.Len() > 0)
+	case reflect.Array, reflect.String:
+		return starlark.Bool(u.rvalue.Len() > 0)
+	}
+	return !starlark.Bool(u.rvalue.IsZero())
 }
 
+// Hash is defined for comparable go values, pointers hash by identity.
 func (u *UserValue) Hash() (uint32, error) {
-	// todo return object hash
-	return 0, fmt.Errorf("unhashable")
+	if !u.rtype.Comparable() {
+		return 0, fmt.Errorf("unhashable type: %s", u.Type())
+	}
+	h := fnv.New32a()
+	switch u.rvalue.Kind() {
+	case reflect.Chan, reflect.Ptr, reflect.UnsafePointer:
+		fmt.Fprintf(h, "%x", u.rvalue.Pointer())
+	default:
+		fmt.Fprintf(h, "%#v", u.goValue())
+	}
+	return h.Sum32(), nil
+}
+
+// CompareSameType compares comparable go values with go ==, other values by
+// identity. Values of ordered kinds, like a named int or string, are ordered,
+// as are values with a Cmp method.
+func (u *UserValue) CompareSameType(op syntax.Token, y starlark.Value, depth int) (_ bool, err error) {
+	defer recoverPanic(u.Type()+".Compare", &err)
+	other, _ := asUserValue(y)
+	if op == syntax.EQL || op == syntax.NEQ {
+		return u.equal(other) == (op == syntax.EQL), nil
+	}
+	if u.rtype != other.rtype {
+		return false, fmt.Errorf("%s %s %s not implemented", u.Type(), op, other.Type())
+	}
+	var cmp int
+	switch x, y := u.rvalue, other.rvalue; x.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		cmp = threeway(x.Int() < y.Int(), x.Int() > y.Int())
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		cmp = threeway(x.Uint() < y.Uint(), x.Uint() > y.Uint())
+	case reflect.Float32, reflect.Float64:
+		cmp = threeway(x.Float() < y.Float(), x.Float() > y.Float())
+	case reflect.String:
+		cmp = threeway(x.String() < y.String(), x.String() > y.String())
+	default:
+		var ok bool
+		if cmp, ok = u.compareMethod(other); !ok {
+			return false, fmt.Errorf("%s %s %s not implemented", u.Type(), op, other.Type())
+		}
+	}
+	switch op {
+	case syntax.LT:
+		return cmp < 0, nil
+	case syntax.LE:
+		return cmp <= 0, nil
+	case syntax.GT:
+		return cmp > 0, nil
+	case syntax.GE:
+		return cmp >= 0, nil
+	}
+	return false, fmt.Errorf("%s %s %s not implemented", u.Type(), op, other.Type())
+}
+
+func (u *UserValue) equal(other *UserValue) bool {
+	if u.rtype != other.rtype {
+		return false
+	}
+	if u.rtype.Comparable() {
+		return u.goValue() == other.goValue()
+	}
+	switch u.rvalue.Kind() {
+	case reflect.Map, reflect.Func:
+		return u.rvalue.Pointer() == other.rvalue.Pointer()
+	case reflect.Slice:
+		return u.rvalue.Pointer() == other.rvalue.Pointer() && u.rvalue.Len() == other.rvalue.Len()
+	}
+	return u == other
+}
+
+func threeway(less, greater bool) int {
+	switch {
+	case less:
+		return -1
+	case greater:
+		return 1
+	}
+	return 0
 }
 
 func (u *UserValue) Name() string {
 	switch u.rtype.Kind() {
 	case reflect.Func:
-		return u.rtype.Name()
+		if u.name != "" {
+			return u.name
+		}
+		return funcName(u.rvalue)
 	default:
-		panic(unsupportedError{Type: u.rtype, Method: "Name"})
+		return u.Type()
 	}
 }
 
-func (u *UserValue) CallInternal(thread *starlark.Thread, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
-	if len(kwargs) > 0 {
-		return starlark.None, unsupportedError{Type: u.rtype, Method: "Call with kwargs"}
+// callGo calls the wrapped go func, lending thread to callbacks it calls,
+// see callbackCaller, and cancelling its context if thread is cancelled
+// meanwhile. err is the error a callback of call reported, see
+// callbackCaller.report.
+func (u *UserValue) callGo(thread *starlark.Thread, call *goCall, args []reflect.Value, spread bool) (results []reflect.Value, err error) {
+	leave := enterGoCall(thread, call)
+	defer func() {
+		if callbackErr := leave(); callbackErr != nil && err == nil {
+			err = callbackErr
+		}
+	}()
+	if usesThreadContext(thread, args) {
+		defer watchCancel(thread)()
+	}
+	if spread {
+		return u.rvalue.CallSlice(args), nil
 	}
+	return u.rvalue.Call(args), nil
+}
+
+func (u *UserValue) CallInternal(thread *starlark.Thread, args starlark.Tuple, kwargs []starlark.Tuple) (_ starlark.Value, err error) {
+	defer recoverPanic(u.Name(), &err)
 	if u.rvalue.Kind() == reflect.Func {
-		var argValues []reflect.Value
-		for i := 0; i < u.rtype.NumIn(); i++ {
-			inType := u.rtype.In(i)
-			v, err := sValueToReflect(thread, args[i], inType)
-			if err != nil {
-				return starlark.None, err
+		if u.injectContext(args) {
+			args = append(starlark.Tuple{u.conv.newUserValue(contextOf(thread), thread)}, args...)
+		}
+		args, spread, err := u.bindArgs(args, kwargs)
+		if err != nil {
+			return starlark.None, err
+		}
+		call := new(goCall)
+		argValues, err := func() ([]reflect.Value, error) {
+			defer convertingFor(thread, call)()
+			return u.convertArgs(thread, args, spread)
+		}()
+		if err != nil {
+			return starlark.None, err
+		}
+		retValues, err := u.callGo(thread, call, argValues, spread)
+		if err != nil {
+			return starlark.None, err
+		}
+		if n := len(retValues); u.raiseErrors && n > 0 && u.rtype.Out(n-1) == refTypeError {
+			if errValue := retValues[n-1]; !errValue.IsNil() {
+				return starlark.None, fmt.Errorf("%s: %w", u.Name(), errValue.Interface().(error))
 			}
-			argValues = append(argValues, v)
+			retValues = retValues[:n-1]
 		}
-		retValues := u.rvalue.Call(argValues)
 		var ret []starlark.Value
 		for index := range retValues {
-			ret = append(ret, ToValue(retValues[index].Interface()))
+			v, err := u.convertResult(retValues[index].Interface(), thread)
+			if err != nil {
+				return starlark.None, fmt.Errorf("%s: %w", u.Name(), err)
+			}
+			ret = append(ret, v)
 		}
 		if len(ret) == 0 {
 			return starlark.None, nil
@@ -82,115 +341,173 @@ func (u *UserValue) CallInternal(thread *starlark.Thread, args starlark.Tuple, k
 	return starlark.None, unsupportedError{Type: u.rtype, Method: "Call"}
 }
 
-func (u *UserValue) Iterate() starlark.Iterator {
-	if u.rvalue.Kind() == reflect.Map {
-		return &userValueIterator{m: u.rvalue.MapRange()}
+// Slice implements starlark.Sliceable, start, end and step are already
+// clamped to Len by the interpreter, step may be negative.
+func (u *UserValue) Slice(start, end, step int) starlark.Value {
+	rvalue := u.rvalue
+	if rvalue.Kind() == reflect.Ptr && (u.rtype.Elem().Kind() == reflect.Array || u.rtype.Elem().Kind() == reflect.Slice) {
+		if rvalue.IsNil() {
+			return starlark.None
+		}
+		rvalue = rvalue.Elem()
+	}
+	switch rvalue.Kind() {
+	case reflect.String:
+		str := rvalue.String()
+		if step == 1 {
+			return starlark.String(str[start:end])
+		}
+		var b []byte
+		for i := start; sliceContinues(i, end, step); i += step {
+			b = append(b, str[i])
+		}
+		return starlark.String(b)
+	case reflect.Slice, reflect.Array:
+	default:
+		return starlark.None
 	}
-	return &userValueIterator{l: u}
-}
-
-type userValueIterator struct {
-	l *UserValue
-	m *reflect.MapIter
-	i int
-}
 
-func (it *userValueIterator) Next(p *starlark.Value) bool {
-	if it.m != nil {
-		if it.m.Next() {
-			*p = ToValue(it.m.Key().Interface())
-			return true
+	if u.conv.SliceViews {
+		if step == 1 && (rvalue.Kind() == reflect.Slice || rvalue.CanAddr()) {
+			return u.toValue(rvalue.Slice(start, end).Interface())
 		}
-		return false
+		elems := reflect.MakeSlice(reflect.SliceOf(rvalue.Type().Elem()), 0, 0)
+		for i := start; sliceContinues(i, end, step); i += step {
+			elems = reflect.Append(elems, rvalue.Index(i))
+		}
+		return u.toValue(elems.Interface())
 	}
+	var values []starlark.Value
+	for i := start; sliceContinues(i, end, step); i += step {
+		values = append(values, u.toValue(rvalue.Index(i).Interface()))
+	}
+	return starlark.NewList(values)
+}
 
-	if it.i < it.l.Len() {
-		*p = it.l.Index(it.i)
-		it.i++
-		return true
+// sliceContinues reports whether index i is before end in the direction of
+// step.
+func sliceContinues(i, end, step int) bool {
+	if step > 0 {
+		return i < end
 	}
-	return false
+	return i > end
 }
 
-func (it *userValueIterator) Done() {
+func (u *UserValue) SetIndex(index int, v starlark.Value) (err error) {
+	defer recoverPanic(u.Type()+".SetIndex", &err)
+	if err := u.checkMutable("assign to element of"); err != nil {
+		return err
+	}
+	elems, ok := u.sequence()
+	if !ok || elems.Kind() == reflect.String {
+		return unsupportedError{Type: u.rtype, Method: "SetIndex"}
+	}
+	elem := elems.Index(index)
+	if !elem.CanSet() {
+		return fmt.Errorf("cannot assign to element of unaddressable %s", u.Type())
+	}
+	value, err := u.conv.sValueToReflect(u.thread, v, elem.Type())
+	if err != nil {
+		return err
+	}
+	elem.Set(value)
+	return nil
 }
 
-func (u *UserValue) Slice(start, end, step int) starlark.Value {
-	if u.rtype.Kind() != reflect.Slice && u.rtype.Kind() != reflect.Array {
-		panic(unsupportedError{Type: u.rtype, Method: "Slice"})
+// sequence returns the go slice, array or string wrapped by u, following a
+// pointer to a slice or array.
+func (u *UserValue) sequence() (reflect.Value, bool) {
+	rvalue := u.rvalue
+	if rvalue.Kind() == reflect.Ptr && !rvalue.IsNil() {
+		rvalue = rvalue.Elem()
 	}
-	v := u.rvalue.Slice3(start, end, step)
-	var values []starlark.Value
-	for i := 0; i < v.Len(); i++ {
-		values = append(values, ToValue(v.Index(i)))
+	switch rvalue.Kind() {
+	case reflect.Slice, reflect.Array, reflect.String:
+		return rvalue, true
 	}
-	return starlark.NewList(values)
+	return reflect.Value{}, false
 }
 
-func (u *UserValue) SetIndex(index int, v starlark.Value) error {
-	if u.rtype.Kind() != reflect.Slice && u.rtype.Kind() != reflect.Array && u.rtype.Kind() != reflect.String {
-		return unsupportedError{Type: u.rtype, Method: "SetIndex"}
+// sequenceIndex converts the key of x[k] to an index of a sequence of length
+// n, counting negative indices from the end like starlark lists. The
+// interpreter asks a Mapping before an Indexable, so Get and SetKey route
+// integer keys of sequences created by NewUserValue here, ToValue wraps them
+// as Sequence instead.
+func sequenceIndex(k starlark.Value, n int) (int, error) {
+	i, err := starlark.AsInt32(k)
+	if err != nil {
+		return 0, fmt.Errorf("index: %s", err)
 	}
-	typeHint := u.rvalue.Elem().Type()
-	if v, err := sValueToReflect(u.thread, v, typeHint); err != nil {
-		return err
-	} else {
-		u.rvalue.Index(index).Set(v)
+	orig := i
+	if i < 0 {
+		i += n
 	}
-	return nil
+	if i < 0 || i >= n {
+		return 0, fmt.Errorf("index %d out of range [%d:%d]", orig, -n, n-1)
+	}
+	return i, nil
 }
 
 func (u *UserValue) Get(k starlark.Value) (v starlark.Value, found bool, err error) {
-	if u.rvalue.Kind() == reflect.Map {
-		keyType := u.rtype.Key()
-		key, err := sValueToReflect(u.thread, k, keyType)
+	defer recoverPanic(u.Type()+".Get", &err)
+	if m, ok := u.mapping(); ok {
+		key, err := u.conv.sValueToReflect(u.thread, k, m.Type().Key())
 		if err != nil {
-			return starlark.None, false, err
+			// a key of another type is not in the map, like in a dict
+			return starlark.None, false, nil
 		}
-		value := u.rvalue.MapIndex(key)
+		value := m.MapIndex(key)
 		if !value.IsValid() {
 			return starlark.None, false, nil
 		}
-		return ToValue(value.Interface()), true, nil
+		return u.toValue(value.Interface()), true, nil
+	}
+	if elems, ok := u.sequence(); ok {
+		i, err := sequenceIndex(k, elems.Len())
+		if err != nil {
+			return starlark.None, false, err
+		}
+		return u.Index(i), true, nil
 	}
 	return starlark.None, false, unsupportedError{Type: u.rtype, Method: "Get"}
 }
 
 func (u *UserValue) Items() (ret []starlark.Tuple) {
-	if u.rvalue.Kind() == reflect.Map {
-		iter := u.rvalue.MapRange()
-		for iter.Next() {
-			ret = append(ret, starlark.Tuple{
-				ToValue(iter.Key()), ToValue(iter.Value()),
-			})
-		}
-		return
+	m, ok := u.mapping()
+	if !ok {
+		return nil
+	}
+	for _, key := range u.mapKeys(m) {
+		ret = append(ret, starlark.Tuple{
+			u.toValue(key.Interface()), u.toValue(m.MapIndex(key).Interface()),
+		})
 	}
-	panic(unsupportedError{Type: u.rtype, Method: "Items"})
+	return ret
 }
 
-func (u *UserValue) SetKey(k, v starlark.Value) error {
-	if u.rvalue.Kind() == reflect.Map {
-		keyType := u.rtype.Key()
-		elemType := u.rtype.Elem()
-		lKey, err := sValueToReflect(u.thread, k, keyType)
-		if err != nil {
-			return err
-		}
-		lValue, err := sValueToReflect(u.thread, v, elemType)
+func (u *UserValue) SetKey(k, v starlark.Value) (err error) {
+	defer recoverPanic(u.Type()+".SetKey", &err)
+	if err := u.checkMutable("insert into"); err != nil {
+		return err
+	}
+	if m, ok := u.mapping(); ok {
+		return u.setMapIndex(u.thread, m, k, v)
+	}
+	if elems, ok := u.sequence(); ok {
+		i, err := sequenceIndex(k, elems.Len())
 		if err != nil {
 			return err
 		}
-		u.rvalue.SetMapIndex(lKey, lValue)
-		return nil
+		return u.SetIndex(i, v)
 	}
-	panic(unsupportedError{Type: u.rtype, Method: "SetKey"})
+	return unsupportedError{Type: u.rtype, Method: "SetKey"}
 }
 
-func (u *UserValue) Attr(name string) (starlark.Value, error) {
-	m := u.rvalue.MethodByName(name)
-	if m.IsValid() {
-		return ToValue(m.Interface()), nil
+func (u *UserValue) Attr(name string) (_ starlark.Value, err error) {
+	defer recoverPanic(u.Type()+"."+name, &err)
+	// go method names first, then fields, then method aliases
+	if m, ok := u.conv.methodByName(u.rvalue, name, false); ok {
+		return u.method(m, name), nil
 	}
 
 	rvalue := u.rvalue
@@ -198,41 +515,102 @@ func (u *UserValue) Attr(name string) (starlark.Value, error) {
 		rvalue = rvalue.Elem()
 	}
 	if rvalue.Kind() == reflect.Struct {
-		field := rvalue.FieldByName(name)
-		if !field.IsValid() || !field.CanInterface() {
-			return starlark.None, unsupportedError{Type: u.rtype, Method: "Attr: " + name}
+		if field, ok := u.conv.fieldByName(rvalue, name, false); ok {
+			if !field.IsValid() {
+				// promoted through a nil embedded pointer
+				return starlark.None, nil
+			}
+			// through a pointer methods and list methods change the field, and
+			// a nil slice field is an empty sequence instead of None
+			switch field.Kind() {
+			case reflect.Struct, reflect.Array, reflect.Slice:
+				if field.CanAddr() {
+					field = field.Addr()
+				}
+			}
+			return u.toValue(field.Interface()), nil
 		}
-		if (field.Kind() == reflect.Struct || field.Kind() == reflect.Array) && field.CanAddr() {
-			field = field.Addr()
+	}
+	if rvalue.Kind() == reflect.Map {
+		if b, ok := mapMethods[name]; ok {
+			return b.BindReceiver(u), nil
 		}
-		return ToValue(field.Interface()), nil
+	}
+	if rvalue.Kind() == reflect.Slice {
+		if b, ok := sliceMethods[name]; ok {
+			return b.BindReceiver(u), nil
+		}
+	}
+	if m, ok := u.conv.methodByName(u.rvalue, name, true); ok {
+		return u.method(m, name), nil
+	}
+	if rvalue.Kind() == reflect.Struct {
+		return starlark.None, unsupportedError{Type: u.rtype, Method: "Attr: " + name}
 	}
 	return starlark.None, unsupportedError{Type: u.rtype, Method: "Attr"}
 }
 
-func (u *UserValue) AttrNames() (ret []string) {
-	// todo attrNames should return methodNames?
+func (u *UserValue) method(m reflect.Value, name string) *UserValue {
+	method := u.conv.newUserValue(m.Interface(), u.thread)
+	method.name = u.Type() + "." + name
+	method.raiseErrors = u.raiseErrors
+	return method
+}
+
+func (u *UserValue) AttrNames() []string {
+	names := map[string]bool{}
 	rvalue := u.rvalue
 	if rvalue.Kind() == reflect.Ptr {
 		rvalue = rvalue.Elem()
 	}
 	if rvalue.Kind() == reflect.Struct {
-		for i := 0; i < rvalue.NumField(); i++ {
-			ret = append(ret, u.rtype.Field(i).Name)
+		for _, f := range u.conv.structFields(rvalue.Type()) {
+			names[f.name] = true
+		}
+	}
+	if rvalue.Kind() == reflect.Map {
+		for name := range mapMethods {
+			names[name] = true
+		}
+	}
+	if rvalue.Kind() == reflect.Slice {
+		for name := range sliceMethods {
+			names[name] = true
 		}
 	}
+	recv := methodReceiver(u.rvalue).Type()
+	for i := 0; i < recv.NumMethod(); i++ {
+		names[recv.Method(i).Name] = true
+	}
+	if u.conv.SnakeCaseMethods {
+		for alias := range u.conv.methodAliases(recv) {
+			names[alias] = true
+		}
+	}
+	ret := make([]string, 0, len(names))
+	for name := range names {
+		ret = append(ret, name)
+	}
+	sort.Strings(ret)
 	return ret
 }
 
-func (u *UserValue) SetField(name string, val starlark.Value) error {
+func (u *UserValue) SetField(name string, val starlark.Value) (err error) {
+	defer recoverPanic(u.Type()+"."+name, &err)
+	if err := u.checkMutable("set field of"); err != nil {
+		return err
+	}
 	// todo SetField could set method?
 	rvalue := u.rvalue
 	if rvalue.Kind() == reflect.Ptr {
 		rvalue = rvalue.Elem()
 	}
 	if rvalue.Kind() == reflect.Struct {
-		field := rvalue.FieldByName(name)
-		value, err := sValueToReflect(u.thread, val, field.Type())
+		field, ok := u.conv.fieldByName(rvalue, name, true)
+		if !ok || !field.IsValid() || !field.CanSet() {
+			return structFieldError{Field: name, Type: rvalue.Type()}
+		}
+		value, err := u.conv.sValueToReflect(u.thread, val, field.Type())
 		if err != nil {
 			return err
 		}
@@ -245,25 +623,30 @@ func (u *UserValue) SetField(name string, val starlark.Value) error {
 func (u *UserValue) Index(i int) starlark.Value {
 	switch u.rtype.Kind() {
 	case reflect.Array, reflect.Slice:
-		return ToValue(u.rvalue.Index(i).Interface())
+		return u.toValue(u.rvalue.Index(i).Interface())
+	case reflect.String:
+		return starlark.String(u.rvalue.String()[i : i+1])
 	case reflect.Ptr:
 		switch u.rtype.Elem().Kind() {
-		case reflect.Array:
-			return ToValue(u.rvalue.Elem().Index(i).Interface())
+		case reflect.Array, reflect.Slice:
+			return u.toValue(u.rvalue.Elem().Index(i).Interface())
 		}
 	}
-	panic(unsupportedError{Type: u.rtype, Method: "Index"})
+	return starlark.None
 }
 
 func (u *UserValue) Len() int {
 	switch u.rtype.Kind() {
-	case reflect.Array, reflect.Map, reflect.Slice, reflect.Chan:
+	case reflect.Array, reflect.Map, reflect.Slice, reflect.Chan, reflect.String:
 		return u.rvalue.Len()
 	case reflect.Ptr:
 		switch u.rtype.Elem().Kind() {
 		case reflect.Array, reflect.Map, reflect.Slice, reflect.Chan:
+			if u.rvalue.IsNil() {
+				return 0
+			}
 			return u.rvalue.Elem().Len()
 		}
 	}
-	panic(unsupportedError{Type: u.rtype, Method: "Len"})
+	return -1
 }